@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// A backend carries out the operations against influxdb that are needed
+// by the push/pull commands.
+type backend interface {
+	// export fetches the template for a stack, in yaml format.
+	export(stackID string) (io.Reader, error)
+
+	// exportFiltered fetches a template of the resources selected by
+	// the filter, which needn't belong to a stack, in yaml format.
+	exportFiltered(filter exportFilter) (io.Reader, error)
+
+	// apply applies the template in the file to a stack, along with the
+	// values of any secrets it references. The force argument matches the
+	// --force flag of the influx cli.
+	apply(stackID, filename, force string, secrets map[string]string) error
+
+	// summarize returns a summary of the changes that applying the
+	// template in the file would make, without applying it.
+	summarize(stackID, filename string, secrets map[string]string) (string, error)
+
+	// listStacks returns all of the stacks in the organization.
+	listStacks() ([]stack, error)
+
+	// getStack returns a single stack.
+	getStack(stackID string) (stack, error)
+
+	// initStack creates a new stack with no resources.
+	initStack(name, description string) (stack, error)
+
+	// addResources adds existing resources to a stack.
+	addResources(stackID string, resources []stackResource) error
+
+	// deleteStack deletes a stack, along with all of its resources.
+	deleteStack(stackID string) error
+}
+
+// A stack is a collection of resources that are managed together.
+// Each change to the stack is recorded as an event, with the latest
+// one holding its current state.
+type stack struct {
+	ID     string       `json:"id"`
+	Events []stackEvent `json:"events"`
+}
+
+type stackEvent struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Resources   []stackResource `json:"resources"`
+}
+
+// A stackResource identifies a resource belonging to a stack.
+type stackResource struct {
+	Kind       string `json:"kind"`
+	ResourceID string `json:"resourceID"`
+	MetaName   string `json:"templateMetaName,omitempty"`
+}
+
+// An exportFilter selects resources to export by ID, or by label and kind.
+type exportFilter struct {
+	resources []stackResource
+	labels    []string
+	kinds     []string
+}
+
+func (f exportFilter) empty() bool {
+	return len(f.resources) == 0 && len(f.labels) == 0 && len(f.kinds) == 0
+}
+
+// latest returns the latest event for the stack.
+func (s stack) latest() stackEvent {
+	if len(s.Events) == 0 {
+		return stackEvent{}
+	}
+	return s.Events[len(s.Events)-1]
+}
+
+// parseResource parses a resource in the form <kind>=<id>.
+func parseResource(s string) (stackResource, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return stackResource{}, fmt.Errorf("invalid resource %q, expected <kind>=<id>", s)
+	}
+	return stackResource{Kind: parts[0], ResourceID: parts[1]}, nil
+}
+
+// confirm asks the user to confirm an action, returning whether they did.
+func confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprint(out, prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// newBackend returns the backend selected by the user.
+func (cfg config) newBackend() (backend, error) {
+	switch cfg.backend {
+	case "cli":
+		return cliBackend{cfg: cfg}, nil
+
+	case "http":
+		return newHTTPBackend(cfg)
+
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected 'cli' or 'http'", cfg.backend)
+	}
+}
+
+// A cliBackend calls the influx cli tool to talk to influxdb.
+type cliBackend struct {
+	cfg config
+}
+
+func (b cliBackend) export(stackID string) (io.Reader, error) {
+	args := []string{"export", "stack", stackID}
+	args = append(args, b.cfg.generateArgs()...)
+	if b.cfg.dryRun {
+		b.logDryRun(args)
+		return nil, nil
+	}
+
+	cmd := exec.Command(b.cfg.influxCmd, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = b.cfg.stderr()
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New(out.String())
+	}
+
+	return &out, nil
+}
+
+func (b cliBackend) exportFiltered(filter exportFilter) (io.Reader, error) {
+	args, err := exportArgs(filter)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, b.cfg.generateArgs()...)
+	if b.cfg.dryRun {
+		b.logDryRun(args)
+		return nil, nil
+	}
+
+	cmd := exec.Command(b.cfg.influxCmd, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = b.cfg.stderr()
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New(out.String())
+	}
+
+	return &out, nil
+}
+
+// exportFlags maps the kinds of resources to the influx export flag
+// used to select them by ID.
+var exportFlags = map[string]string{
+	kindBucket:             "--buckets",
+	"Check":                "--checks",
+	kindCheck:              "--checks",
+	kindDeadman:            "--checks",
+	kindDashboard:          "--dashboards",
+	"NotificationEndpoint": "--endpoints",
+	kindEndpointHTTP:       "--endpoints",
+	kindEndpointPagerDuty:  "--endpoints",
+	kindEndpointSlack:      "--endpoints",
+	kindLabel:              "--labels",
+	kindRule:               "--rules",
+	kindTask:               "--tasks",
+	kindTelegraf:           "--telegraf-configs",
+	kindVariable:           "--variables",
+}
+
+// exportArgs returns the influx cli arguments to export the filtered resources.
+// Resources are exported by ID with "influx export", and by label or kind with
+// "influx export all", so the two can't be mixed.
+func exportArgs(filter exportFilter) ([]string, error) {
+	if len(filter.resources) > 0 {
+		if len(filter.labels) > 0 || len(filter.kinds) > 0 {
+			return nil, errors.New("the cli backend can't export resources by ID along with labels or kinds, use --backend http")
+		}
+
+		ids := map[string][]string{}
+		var flags []string
+		for _, r := range filter.resources {
+			flag, ok := exportFlags[r.Kind]
+			if !ok {
+				return nil, fmt.Errorf("unable to export resources of kind %q", r.Kind)
+			}
+			if _, ok := ids[flag]; !ok {
+				flags = append(flags, flag)
+			}
+			ids[flag] = append(ids[flag], r.ResourceID)
+		}
+
+		args := []string{"export"}
+		for _, flag := range flags {
+			args = append(args, flag, strings.Join(ids[flag], ","))
+		}
+		return args, nil
+	}
+
+	args := []string{"export", "all"}
+	for _, l := range filter.labels {
+		args = append(args, "--filter", "labelName="+l)
+	}
+	for _, k := range filter.kinds {
+		args = append(args, "--filter", "resourceKind="+k)
+	}
+	return args, nil
+}
+
+func (b cliBackend) apply(stackID, filename, force string, secrets map[string]string) error {
+	args := []string{"apply", "--stack-id", stackID, "-f", filename}
+	args = append(args, b.cfg.generateArgs()...)
+	if force != "" {
+		args = append(args, "--force", force)
+	}
+
+	// Secrets are passed as flags, so that they are never written to a file,
+	// but are kept out of dry run output.
+	var keys []string
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	shown := append([]string{}, args...)
+	for _, k := range keys {
+		args = append(args, "--secret", k+"="+secrets[k])
+		shown = append(shown, "--secret", k+"="+redacted)
+	}
+
+	if b.cfg.dryRun {
+		b.logDryRun(shown)
+		return nil
+	}
+
+	cmd := exec.Command(b.cfg.influxCmd, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = b.cfg.stdout()
+	cmd.Stderr = b.cfg.stderr()
+	return cmd.Run()
+}
+
+// summarize isn't supported, as the influx cli can only show the changes
+// as part of its confirmation prompt.
+func (b cliBackend) summarize(stackID, filename string, secrets map[string]string) (string, error) {
+	return "", errors.New("summarizing changes is only supported by the http backend, set --backend http")
+}
+
+func (b cliBackend) listStacks() ([]stack, error) {
+	var stacks []stack
+	err := b.runJSON([]string{"stacks", "--json"}, &stacks)
+	return stacks, err
+}
+
+func (b cliBackend) getStack(stackID string) (stack, error) {
+	var stacks []stack
+	if err := b.runJSON([]string{"stacks", "--stack-id", stackID, "--json"}, &stacks); err != nil {
+		return stack{}, err
+	}
+	if len(stacks) == 0 {
+		if b.cfg.dryRun {
+			return stack{ID: stackID}, nil
+		}
+		return stack{}, fmt.Errorf("stack %q not found", stackID)
+	}
+	return stacks[0], nil
+}
+
+func (b cliBackend) initStack(name, description string) (stack, error) {
+	args := []string{"stacks", "init", "--stack-name", name, "--json"}
+	if description != "" {
+		args = append(args, "--stack-description", description)
+	}
+
+	var s stack
+	err := b.runJSON(args, &s)
+	return s, err
+}
+
+func (b cliBackend) addResources(stackID string, resources []stackResource) error {
+	args := []string{"stacks", "update", "--stack-id", stackID, "--json"}
+	for _, r := range resources {
+		args = append(args, "--addResource", r.Kind+"="+r.ResourceID)
+	}
+	return b.runJSON(args, nil)
+}
+
+func (b cliBackend) deleteStack(stackID string) error {
+	return b.runJSON([]string{"stacks", "rm", "--stack-id", stackID, "--force"}, nil)
+}
+
+// runJSON runs the influx cli, decoding its output as json into out if it isn't nil.
+func (b cliBackend) runJSON(args []string, out interface{}) error {
+	args = append(args, b.cfg.generateArgs()...)
+	if b.cfg.dryRun {
+		b.logDryRun(args)
+		return nil
+	}
+
+	cmd := exec.Command(b.cfg.influxCmd, args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = b.cfg.stderr()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", b.cfg.influxCmd, err)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("unable to decode output of %s: %v", b.cfg.influxCmd, err)
+	}
+	return nil
+}
+
+func (b cliBackend) logDryRun(args []string) {
+	w := b.cfg.stderr()
+	fmt.Fprintln(w, "Dry run - calling:")
+	fmt.Fprintln(w, b.cfg.influxCmd, strings.Join(args, " "))
+}
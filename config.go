@@ -1,10 +1,15 @@
 package main
 
 import (
+	"io"
+	"os"
+
 	"github.com/spf13/pflag"
 )
 
 // A config holds all the flags that are handled by the push/pull commands.
+// Flags which aren't set can be filled in from an environment in the project
+// manifest, see parse.
 type config struct {
 	// Flags to pass to influx command
 	activeConfig string
@@ -16,10 +21,26 @@ type config struct {
 	token        string
 
 	// Flags used internally
-	help      bool
-	directory string
-	influxCmd string
-	dryRun    bool
+	help        bool
+	directory   string
+	extractors  string
+	influxCmd   string
+	backend     string
+	dryRun      bool
+	data        dataOptions
+	env         string
+	manifest    string
+	backupDir   string
+	noBackup    bool
+	external    bool
+	secretsFile string
+
+	// Stack ID from the environment, used if none is given as an argument.
+	envStackID string
+
+	// Where the output of influxdb operations is written, if not stdout and
+	// stderr. Used to keep the output of concurrent pushes apart.
+	out io.Writer
 }
 
 // flagSet generates a flagSet to use in parsing the flags.
@@ -34,8 +55,13 @@ func (cfg *config) flagSet() *pflag.FlagSet {
 	fs.StringVarP(&cfg.token, "token", "t", "", "Authentication token. Maps to env var $INFLUX_TOKEN.")
 	fs.BoolVarP(&cfg.help, "help", "h", false, "Display help for this command.")
 	fs.StringVarP(&cfg.directory, "directory", "d", "templates", "Directory to read and write templates from/to.")
+	fs.StringVar(&cfg.extractors, "extractors", "", "File declaring extra nodes to extract from templates.")
 	fs.StringVar(&cfg.influxCmd, "influx-cmd", "influx", "Command to call the influx cli, if it not in your path.")
-	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Prints the command piped to the influx cli tool instead of running it if set.")
+	fs.StringVar(&cfg.backend, "backend", "cli", "How to talk to influxdb: 'cli' calls the influx cli, 'http' calls the API directly.")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Prints the command piped to the influx cli tool (or the API request) instead of running it if set.")
+	fs.StringVarP(&cfg.env, "env", "e", "", "Environment in the project manifest to take the stack and other settings from.")
+	fs.StringVar(&cfg.manifest, "manifest", manifestFile, "Project manifest declaring environments.")
+	fs.StringVar(&cfg.secretsFile, "secrets-file", "", "File holding the values of secrets referenced by templates. Values can also be set with $INFLUX_SECRET_<KEY>.")
 	return fs
 }
 
@@ -62,3 +88,19 @@ func (cfg config) generateArgs() []string {
 
 	return args
 }
+
+// stdout returns where to write the output of influxdb operations.
+func (cfg config) stdout() io.Writer {
+	if cfg.out != nil {
+		return cfg.out
+	}
+	return os.Stdout
+}
+
+// stderr returns where to write any errors from influxdb operations.
+func (cfg config) stderr() io.Writer {
+	if cfg.out != nil {
+		return cfg.out
+	}
+	return os.Stderr
+}
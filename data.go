@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"gopkg.in/yaml.v3"
+)
+
+const dataUsage = `Print the data that templates are united with.
+
+When --data-file is repeated, each file is merged over the ones before it.
+Maps are merged key by key, at every level, while any other value, including
+a list, replaces the one before it entirely. Values given with --set and
+--set-string are then set over the top. The merged data is printed as yaml,
+with the file or flag that each value came from as a comment.
+
+Usage:
+  influxdb-stack-manager data [--data-file <file>...] [--set <key>=<value>...] [flags]
+
+Flags:
+`
+
+func data(args []string) error {
+	var cfg config
+	fs := cfg.flagSet()
+	cfg.data.flags(fs)
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager data -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(dataUsage + fs.FlagUsages())
+		return nil
+	}
+
+	if cfg.data.empty() {
+		return fmt.Errorf("Error: no data given, set --data-file or --set\nSee 'influxdb-stack-manager data -h' for help")
+	}
+
+	merged, sources, err := mergeDataFiles(cfg.data.files)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	overrides, err := cfg.data.overrides()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if merged, err = applyOverrides(merged, overrides, sources); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	if err := printData(cfg.stdout(), merged, sources); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	return nil
+}
+
+// printData writes the data as yaml, commenting each value with its source.
+func printData(w io.Writer, data interface{}, sources map[string]string) error {
+	var node yaml.Node
+	if err := node.Encode(data); err != nil {
+		return fmt.Errorf("unable to encode data: %v", err)
+	}
+	commentSources(&node, "", sources)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return fmt.Errorf("unable to encode data: %v", err)
+	}
+	return enc.Close()
+}
+
+// dataOptions are where the data that templates are united with comes from.
+type dataOptions struct {
+	files      []string
+	sets       []string
+	setStrings []string
+}
+
+// flags adds the flags for the data used by the commands which unite templates.
+func (o *dataOptions) flags(fs *pflag.FlagSet) {
+	fs.StringArrayVar(&o.files, "data-file", nil, "Data file to use for injected data in templates. Can be repeated, with later files merged over earlier ones.")
+	fs.StringArrayVar(&o.sets, "set", nil, "Set a value in the data, e.g. Thresholds.CPU=90 or Hosts[0]=a, over any data files. Numbers and bools are converted from strings. Can be repeated.")
+	fs.StringArrayVar(&o.setStrings, "set-string", nil, "Set a value in the data, like --set, but always as a string. Can be repeated.")
+}
+
+// empty returns whether no data was given.
+func (o dataOptions) empty() bool {
+	return len(o.files) == 0 && len(o.sets) == 0 && len(o.setStrings) == 0
+}
+
+// load returns the data files merged in order, along with the overrides
+// which are to be set over the top of it, and of any scoped data.
+func (o dataOptions) load() (interface{}, []dataOverride, error) {
+	data, _, err := mergeDataFiles(o.files)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides, err := o.overrides()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, overrides, nil
+}
+
+// A dataOverride is a single value given with --set or --set-string.
+// The path holds map keys as strings and list indices as ints.
+type dataOverride struct {
+	flag  string
+	key   string
+	path  []interface{}
+	value interface{}
+}
+
+// overrides parses the values given with --set, followed by --set-string.
+func (o dataOptions) overrides() ([]dataOverride, error) {
+	var overrides []dataOverride
+	for _, set := range []struct {
+		flag   string
+		values []string
+	}{{"--set", o.sets}, {"--set-string", o.setStrings}} {
+		for _, s := range set.values {
+			i := strings.Index(s, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid %s %q, expected <key>=<value>", set.flag, s)
+			}
+
+			key, value := s[:i], s[i+1:]
+			path, err := parseDataPath(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", set.flag, s, err)
+			}
+
+			override := dataOverride{flag: set.flag, key: key, path: path, value: value}
+			if set.flag == "--set" {
+				override.value = inferValue(value)
+			}
+			overrides = append(overrides, override)
+		}
+	}
+	return overrides, nil
+}
+
+// parseDataPath splits a key such as Checks[0].Level into its map keys and
+// list indices.
+func parseDataPath(key string) ([]interface{}, error) {
+	var path []interface{}
+	for _, part := range strings.Split(key, ".") {
+		name := part
+		var indices string
+		if i := strings.Index(part, "["); i >= 0 {
+			name, indices = part[:i], part[i:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty key in %q", key)
+		}
+		path = append(path, name)
+
+		for indices != "" {
+			end := strings.Index(indices, "]")
+			if indices[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("malformed list index in %q", key)
+			}
+			n, err := strconv.Atoi(indices[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid list index %q in %q", indices[1:end], key)
+			}
+			path = append(path, n)
+			indices = indices[end+1:]
+		}
+	}
+	return path, nil
+}
+
+// inferValue converts a value given with --set to an int, float or bool if
+// it is one, and otherwise leaves it as a string. Durations are left as
+// strings too, so that they render as they were given, e.g. 5m not 5m0s.
+func inferValue(s string) interface{} {
+	if i, err := strconv.Atoi(s); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	return s
+}
+
+// applyOverrides sets each of the overrides in the data, in order. Unless
+// sources is nil, the flag is recorded as the source of each value set.
+// A value set within a list is recorded against the whole list.
+func applyOverrides(data interface{}, overrides []dataOverride, sources map[string]string) (interface{}, error) {
+	for _, o := range overrides {
+		var err error
+		data, err = setValue(data, o.path, o.value, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to %s %q: %v", o.flag, o.key, err)
+		}
+
+		if sources != nil {
+			var path string
+			for _, p := range o.path {
+				key, ok := p.(string)
+				if !ok {
+					break
+				}
+				path = dataPath(path, key)
+			}
+			forgetSources(sources, path)
+			sources[path] = o.flag
+		}
+	}
+	return data, nil
+}
+
+// setValue sets the value at the path within data, creating any maps and
+// lists along the way, and returns the updated data. Lists are extended to
+// fit the index. The key of data within the whole, at, is used for errors.
+func setValue(data interface{}, path []interface{}, value interface{}, at string) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch key := path[0].(type) {
+	case string:
+		m, ok := data.(map[string]interface{})
+		if data == nil {
+			m, ok = map[string]interface{}{}, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q is not a map", at)
+		}
+
+		v, err := setValue(m[key], path[1:], value, dataPath(at, key))
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+		return m, nil
+
+	case int:
+		l, ok := data.([]interface{})
+		if data == nil {
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q is not a list", at)
+		}
+
+		for len(l) <= key {
+			l = append(l, nil)
+		}
+		v, err := setValue(l[key], path[1:], value, fmt.Sprintf("%s[%d]", at, key))
+		if err != nil {
+			return nil, err
+		}
+		l[key] = v
+		return l, nil
+	}
+
+	return nil, fmt.Errorf("unexpected key %v", path[0])
+}
+
+// scopeData returns the data for the templates in a directory, which is the
+// data with the directory's scoped data file, if it has one, merged over it.
+func scopeData(data interface{}, dir string) (interface{}, error) {
+	filename := filepath.Join(dir, scopedDataFile)
+	if _, err := os.Stat(filename); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return data, nil
+		}
+		return nil, fmt.Errorf("unable to read data file %q: %v", filename, err)
+	}
+
+	scoped, err := loadDataFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// The data is shared by other directories, so merge over a copy of it.
+	return mergeData(copyData(data), scoped, "", filename, nil), nil
+}
+
+// scopedDataFiles returns the scoped data files in the kind and resource
+// directories of a template directory.
+func scopedDataFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*/" + scopedDataFile, "*/*/" + scopedDataFile} {
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to find data files in %q: %v", dir, err)
+		}
+		for _, m := range matches {
+			if rel, _ := filepath.Rel(dir, m); !strings.HasPrefix(rel, ".") {
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// copyData returns a copy of the data's maps and lists, so that it can be
+// merged over, or have values set in it, without changing the original.
+func copyData(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			c[k] = copyData(item)
+		}
+		return c
+
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = copyData(item)
+		}
+		return c
+
+	default:
+		return data
+	}
+}
+
+// mergeDataFiles loads each of the data files, and merges them in order. It
+// also returns the file that each value came from, keyed by its dotted path.
+func mergeDataFiles(filenames []string) (interface{}, map[string]string, error) {
+	var merged interface{}
+	sources := map[string]string{}
+	for _, filename := range filenames {
+		data, err := loadDataFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged = mergeData(merged, data, "", filename, sources)
+	}
+	return merged, sources, nil
+}
+
+// mergeData merges src over dst. Maps are merged recursively, and any other
+// value replaces the one in dst, recording filename as the source of the
+// values under path, unless sources is nil.
+func mergeData(dst, src interface{}, path, filename string, sources map[string]string) interface{} {
+	dstMap, dstOK := dst.(map[string]interface{})
+	srcMap, srcOK := src.(map[string]interface{})
+	if dstOK && srcOK {
+		for k, v := range srcMap {
+			dstMap[k] = mergeData(dstMap[k], v, dataPath(path, k), filename, sources)
+		}
+		return dstMap
+	}
+
+	if sources == nil {
+		return src
+	}
+
+	forgetSources(sources, path)
+	recordSources(src, path, filename, sources)
+	return src
+}
+
+// forgetSources removes the sources of the value at path, which is being
+// replaced. That includes the values within it, and any value it is within,
+// such as an empty map that it is being added to.
+func forgetSources(sources map[string]string, path string) {
+	for p := range sources {
+		if p == path || path == "" || p == "" || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") {
+			delete(sources, p)
+		}
+	}
+}
+
+// recordSources records filename as the source of each value in data.
+// Values within maps are recorded individually.
+func recordSources(data interface{}, path, filename string, sources map[string]string) {
+	if m, ok := data.(map[string]interface{}); ok && len(m) > 0 {
+		for k, v := range m {
+			recordSources(v, dataPath(path, k), filename, sources)
+		}
+		return
+	}
+	sources[path] = filename
+}
+
+// dataPath returns the dotted path of a key within the map at path.
+func dataPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// commentSources adds the source of each value in the node as a line comment.
+// Lists and maps have the comment on their key, as they start on the next line.
+func commentSources(node *yaml.Node, path string, sources map[string]string) {
+	if node.Kind == yaml.DocumentNode {
+		for _, n := range node.Content {
+			commentSources(n, path, sources)
+		}
+		return
+	}
+
+	if path == "" {
+		if src, ok := sources[path]; ok {
+			node.HeadComment = src
+		}
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		p := dataPath(path, key.Value)
+
+		src, ok := sources[p]
+		switch {
+		case !ok:
+			commentSources(value, p, sources)
+		case value.Kind == yaml.ScalarNode || len(value.Content) == 0:
+			value.LineComment = src
+		default:
+			key.LineComment = src
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.yml": `Region: eu
+Thresholds:
+  CPU: 75
+  Memory: 60
+Hosts: [a, b]
+Retention:
+  Days: 30
+`,
+		"region.json": `{"Thresholds": {"CPU": 90}, "Hosts": ["c"], "Cluster": {"Name": "eu-1"}}`,
+		"cluster.yml": `Retention: 7d
+Cluster:
+  Size: 3
+`,
+	}
+	var filenames []string
+	for _, name := range []string{"base.yml", "region.json", "cluster.yml"} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(files[name]), 0600); err != nil {
+			t.Fatalf("Unable to write data file: %v", err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	merged, sources, err := mergeDataFiles(filenames)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	exp := map[string]interface{}{
+		"Region":     "eu",
+		"Thresholds": map[string]interface{}{"CPU": 90.0, "Memory": 60},
+		"Hosts":      []interface{}{"c"},
+		"Retention":  "7d",
+		"Cluster":    map[string]interface{}{"Name": "eu-1", "Size": 3},
+	}
+	if diff := cmp.Diff(exp, merged); diff != "" {
+		t.Errorf("Unexpected merged data (-want +got):\n%s", diff)
+	}
+
+	expSources := map[string]string{
+		"Region":            filenames[0],
+		"Thresholds.CPU":    filenames[1],
+		"Thresholds.Memory": filenames[0],
+		"Hosts":             filenames[1],
+		"Retention":         filenames[2],
+		"Cluster.Name":      filenames[1],
+		"Cluster.Size":      filenames[2],
+	}
+	if diff := cmp.Diff(expSources, sources); diff != "" {
+		t.Errorf("Unexpected sources (-want +got):\n%s", diff)
+	}
+
+	var out bytes.Buffer
+	if err := printData(&out, merged, sources); err != nil {
+		t.Fatalf("Unexpected error printing data: %v", err)
+	}
+	expOut := `Cluster:
+  Name: eu-1 # ` + filenames[1] + `
+  Size: 3 # ` + filenames[2] + `
+Hosts: # ` + filenames[1] + `
+  - c
+Region: eu # ` + filenames[0] + `
+Retention: 7d # ` + filenames[2] + `
+Thresholds:
+  CPU: 90 # ` + filenames[1] + `
+  Memory: 60 # ` + filenames[0] + `
+`
+	if diff := cmp.Diff(expOut, out.String()); diff != "" {
+		t.Errorf("Unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestDataOverrides(t *testing.T) {
+	base := func() interface{} {
+		return map[string]interface{}{
+			"Region":     "eu",
+			"Thresholds": map[string]interface{}{"CPU": 75, "Memory": 60},
+			"Hosts":      []interface{}{"a", "b"},
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		sets       []string
+		setStrings []string
+		exp        interface{}
+		err        string
+	}{
+		"nested": {
+			sets: []string{"Thresholds.CPU=90"},
+			exp: map[string]interface{}{
+				"Region":     "eu",
+				"Thresholds": map[string]interface{}{"CPU": 90, "Memory": 60},
+				"Hosts":      []interface{}{"a", "b"},
+			},
+		},
+		"types": {
+			sets: []string{"New.Int=3", "New.Float=0.5", "New.Bool=false", "New.Duration=1h30m", "New.String=eu-1", "New.Empty="},
+			exp: map[string]interface{}{
+				"Region":     "eu",
+				"Thresholds": map[string]interface{}{"CPU": 75, "Memory": 60},
+				"Hosts":      []interface{}{"a", "b"},
+				"New": map[string]interface{}{
+					"Int":      3,
+					"Float":    0.5,
+					"Bool":     false,
+					"Duration": "1h30m",
+					"String":   "eu-1",
+					"Empty":    "",
+				},
+			},
+		},
+		"strings": {
+			sets:       []string{"Region=1"},
+			setStrings: []string{"Region=1.10", "Thresholds.CPU=true"},
+			exp: map[string]interface{}{
+				"Region":     "1.10",
+				"Thresholds": map[string]interface{}{"CPU": "true", "Memory": 60},
+				"Hosts":      []interface{}{"a", "b"},
+			},
+		},
+		"lists": {
+			sets: []string{"Hosts[1]=c", "Hosts[3]=d", "Checks[0].Level=crit"},
+			exp: map[string]interface{}{
+				"Region":     "eu",
+				"Thresholds": map[string]interface{}{"CPU": 75, "Memory": 60},
+				"Hosts":      []interface{}{"a", "c", nil, "d"},
+				"Checks":     []interface{}{map[string]interface{}{"Level": "crit"}},
+			},
+		},
+		"missing value":   {sets: []string{"Region"}, err: `expected <key>=<value>`},
+		"empty key":       {sets: []string{"Thresholds..CPU=1"}, err: `empty key`},
+		"bad index":       {sets: []string{"Hosts[a]=1"}, err: `invalid list index "a"`},
+		"unclosed index":  {sets: []string{"Hosts[1=1"}, err: `malformed list index`},
+		"not a map":       {sets: []string{"Region.Name=1"}, err: `"Region" is not a map`},
+		"not a list":      {sets: []string{"Thresholds[0]=1"}, err: `"Thresholds" is not a list`},
+		"index not a map": {sets: []string{"Hosts[0].Name=1"}, err: `"Hosts[0]" is not a map`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := dataOptions{sets: tc.sets, setStrings: tc.setStrings}
+			overrides, err := opts.overrides()
+			var act interface{}
+			if err == nil {
+				act, err = applyOverrides(base(), overrides, nil)
+			}
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected an error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.exp, act); diff != "" {
+				t.Errorf("Unexpected data (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"gopkg.in/yaml.v3"
+)
+
+const diffUsage = `Compare the template directory with a stack in influxdb.
+
+The stack is exported, as it is by pull, and the directory is united with the
+data file, as it is by push. The two are then compared resource by resource,
+ignoring the order of keys in the templates, with any queries and other
+extracted content compared as files.
+
+Resources are reported as added if they are only in the directory, and so
+would be created by a push, and removed if they are only in influxdb.
+
+Usage:
+  influxdb-stack-manager diff [<stack-id>] [flags]
+
+If no stack-id is given, the one saved in the template directory is used.
+
+Flags:
+`
+
+// Statuses of a resource when comparing the directory with a stack,
+// or with its last snapshot.
+const (
+	statusAdded     = "added"
+	statusRemoved   = "removed"
+	statusModified  = "modified"
+	statusUnchanged = "unchanged"
+)
+
+// Number of unchanged lines shown around each change in a diff.
+const diffContext = 3
+
+// A resourceDiff holds the differences found in a single resource.
+type resourceDiff struct {
+	Kind   string     `json:"kind"`
+	Name   string     `json:"name"`
+	Dir    string     `json:"dir"`
+	Status string     `json:"status"`
+	Diffs  []fileDiff `json:"diffs,omitempty"`
+}
+
+// A fileDiff is a unified diff of one of the files a resource is split into.
+type fileDiff struct {
+	File string `json:"file"`
+	Diff string `json:"diff"`
+}
+
+// exitCode is returned by commands which need to exit with a status code,
+// but have nothing more to report.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+func diff(args []string) error {
+	var cfg config
+	var exit, asJSON bool
+
+	fs := cfg.flagSet()
+	cfg.data.flags(fs)
+	fs.BoolVar(&cfg.external, "allow-external-refs", false, "Allow associations and notification endpoints which are not in the template, as they already exist in influxdb.")
+	fs.BoolVar(&exit, "exit-code", false, "Exit with status 1 if there are any differences.")
+	fs.BoolVar(&asJSON, "json", false, "Output the differences as JSON.")
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager diff -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(diffUsage + fs.FlagUsages())
+		return nil
+	}
+
+	stackID, err := cfg.stackID(fs.Args())
+	if err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager diff -h' for help", err)
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	ex, err := loadExtractors(cfg.extractors)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	data, overrides, err := cfg.data.load()
+	if err != nil {
+		return fmt.Errorf("Error: unable to load data: %v", err)
+	}
+	local, err := loadObjects(cfg.directory, data, overrides, ex, cfg.external)
+	if err != nil {
+		return fmt.Errorf("Error: unable to unite templates: %v", err)
+	}
+
+	out, err := b.export(stackID)
+	if err != nil {
+		return err
+	}
+	if cfg.dryRun {
+		return nil
+	}
+
+	remote, err := decodeObjects(out)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	diffs, err := diffObjects(remote, local, ex)
+	if err != nil {
+		return fmt.Errorf("Error: unable to compare templates: %v", err)
+	}
+
+	if asJSON {
+		err = printDiffsJSON(os.Stdout, diffs)
+	} else {
+		err = printDiffs(os.Stdout, diffs)
+	}
+	if err != nil {
+		return fmt.Errorf("Error: unable to write diff: %v", err)
+	}
+
+	if exit && changed(diffs) {
+		return exitCode(1)
+	}
+	return nil
+}
+
+// diffObjects compares the objects exported from influxdb with the local ones,
+// returning the differences for each resource, ordered by kind and name.
+func diffObjects(remote, local []object, ex extract.Set) ([]resourceDiff, error) {
+	remoteFiles, err := objectFiles(remote, ex)
+	if err != nil {
+		return nil, err
+	}
+	localFiles, err := objectFiles(local, ex)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resources are matched by their metadata name, but shown by the
+	// directory they are split into, preferring the local one.
+	ids := map[string]struct{}{}
+	dirs := map[string]string{}
+	for _, objs := range [][]object{remote, local} {
+		for i := range objs {
+			ids[objs[i].id()] = struct{}{}
+			dirs[objs[i].id()] = objs[i].dir()
+		}
+	}
+
+	var sorted []string
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	var diffs []resourceDiff
+	for _, id := range sorted {
+		r, rok := remoteFiles[id]
+		l, lok := localFiles[id]
+
+		parts := strings.SplitN(id, "/", 2)
+		rd := resourceDiff{Kind: parts[0], Name: parts[1], Dir: dirs[id], Status: statusModified}
+		switch {
+		case !rok:
+			rd.Status = statusAdded
+		case !lok:
+			rd.Status = statusRemoved
+		}
+
+		rd.Diffs = diffFiles(rd.Dir, r, l)
+		if len(rd.Diffs) == 0 {
+			rd.Status = statusUnchanged
+		}
+		diffs = append(diffs, rd)
+	}
+	return diffs, nil
+}
+
+// objectFiles returns the files that each object would be split into, keyed by
+// the object's id. The template itself is reencoded with its keys sorted, so
+// that the order they are written in doesn't matter.
+func objectFiles(objs []object, ex extract.Set) (map[string]map[string]string, error) {
+	files := map[string]map[string]string{}
+	for _, obj := range objs {
+		if _, ok := files[obj.id()]; ok {
+			return nil, fmt.Errorf("%s appears more than once", obj.id())
+		}
+
+		f := map[string]string{}
+		queryNodes := ex.Nodes(obj.Kind, &obj.Spec)
+		for i, name := range queryFilenames(queryNodes) {
+			qn := queryNodes[i]
+			// Editors often add a final newline to the extracted files,
+			// which shouldn't count as a change.
+			f[name] = strings.TrimRight(qn.Node.Value, "\n") + "\n"
+			qn.Node.SetString(queryPrefix + name)
+		}
+
+		template, err := canonicalYAML(obj)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode %s: %v", obj.id(), err)
+		}
+		f[templateFile] = template
+
+		files[obj.id()] = f
+	}
+	return files, nil
+}
+
+// canonicalYAML encodes the value with all of its mapping keys sorted.
+func canonicalYAML(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(generic); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// diffFiles returns a unified diff of each file which differs between the
+// remote and local versions of the resource split into dir.
+func diffFiles(dir string, remote, local map[string]string) []fileDiff {
+	names := map[string]struct{}{}
+	for name := range remote {
+		names[name] = struct{}{}
+	}
+	for name := range local {
+		names[name] = struct{}{}
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diffs []fileDiff
+	for _, name := range sorted {
+		r, rok := remote[name]
+		l, lok := local[name]
+		if rok == lok && r == l {
+			continue
+		}
+
+		file := path.Join(dir, name)
+		from, to := "influxdb/"+file, "local/"+file
+		if !rok {
+			from = "/dev/null"
+		}
+		if !lok {
+			to = "/dev/null"
+		}
+		diffs = append(diffs, fileDiff{File: file, Diff: unifiedDiff(from, to, r, l)})
+	}
+	return diffs
+}
+
+// A diffLine is a single line of a diff, along with its index in each side.
+type diffLine struct {
+	op   byte
+	text string
+	a, b int
+}
+
+// unifiedDiff returns a unified diff between a and b, with the given names.
+func unifiedDiff(aName, bName, a, b string) string {
+	al, bl := splitLines(a), splitLines(b)
+	matches := matchLines(al, bl)
+
+	// Walk both sides, turning the matched lines into a list of edits.
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		next := len(bl)
+		if i < len(al) && matches[i] >= 0 {
+			next = matches[i]
+		}
+		switch {
+		case i < len(al) && matches[i] < 0:
+			lines = append(lines, diffLine{'-', al[i], i, j})
+			i++
+		case j < next:
+			lines = append(lines, diffLine{'+', bl[j], i, j})
+			j++
+		default:
+			lines = append(lines, diffLine{' ', al[i], i, j})
+			i, j = i+1, j+1
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	// Group the changes into hunks, merging any which are close enough
+	// that their context would overlap.
+	for n := 0; n < len(lines); {
+		if lines[n].op == ' ' {
+			n++
+			continue
+		}
+
+		start := n - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := n
+		for k := n; k < len(lines) && k <= end+2*diffContext+1; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		n = end + 1
+		end += diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		writeHunk(&out, lines[start:end])
+	}
+
+	return out.String()
+}
+
+// writeHunk writes a single hunk of a unified diff.
+func writeHunk(out *strings.Builder, lines []diffLine) {
+	var aLen, bLen int
+	for _, l := range lines {
+		if l.op != '+' {
+			aLen++
+		}
+		if l.op != '-' {
+			bLen++
+		}
+	}
+
+	// Line numbers start from one, unless the hunk is empty on that side,
+	// in which case it refers to the line before it.
+	aStart, bStart := lines[0].a, lines[0].b
+	if aLen > 0 {
+		aStart++
+	}
+	if bLen > 0 {
+		bStart++
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+	for _, l := range lines {
+		out.WriteByte(l.op)
+		out.WriteString(l.text)
+		if !strings.HasSuffix(l.text, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// changed returns whether any of the resources have changed.
+func changed(diffs []resourceDiff) bool {
+	for _, d := range diffs {
+		if d.Status != statusUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// printDiffs writes the diff of each changed resource, followed by a summary.
+func printDiffs(w io.Writer, diffs []resourceDiff) error {
+	counts := map[string]int{}
+	for _, d := range diffs {
+		counts[d.Status]++
+		if d.Status == statusUnchanged {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "%s (%s): %s\n", d.Dir, d.Name, d.Status); err != nil {
+			return err
+		}
+		for _, fd := range d.Diffs {
+			if _, err := io.WriteString(w, fd.Diff); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d added, %d modified, %d removed, %d unchanged\n",
+		counts[statusAdded], counts[statusModified], counts[statusRemoved], counts[statusUnchanged])
+	return err
+}
+
+// printDiffsJSON writes the diffs of the changed resources as JSON.
+func printDiffsJSON(w io.Writer, diffs []resourceDiff) error {
+	changes := []resourceDiff{}
+	for _, d := range diffs {
+		if d.Status != statusUnchanged {
+			changes = append(changes, d)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(changes)
+}
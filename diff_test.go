@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	for name, tc := range map[string]struct {
+		a, b string
+		exp  string
+	}{
+		"change": {
+			a:   "a\nb\nc\nd\ne\nf\ng\nh\n",
+			b:   "a\nb\nc\nd\nE\nf\ng\nh\n",
+			exp: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n b\n c\n d\n-e\n+E\n f\n g\n h\n",
+		},
+		"separate hunks": {
+			a:   "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+			b:   "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			exp: "--- a\n+++ b\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n@@ -8,4 +9,3 @@\n 8\n 9\n 10\n-11\n",
+		},
+		"new file": {
+			a:   "",
+			b:   "a\n",
+			exp: "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+a\n",
+		},
+		"no newline": {
+			a:   "a\nb",
+			b:   "a\nc",
+			exp: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.exp, unifiedDiff("a", "b", tc.a, tc.b)); diff != "" {
+				t.Errorf("Unexpected diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	_, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/multiple-template", dir)
+	flags := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir, "--exit-code", "--allow-external-refs"}
+
+	// Reordering the keys in a template isn't a change.
+	label := filepath.Join(dir, "Label/Version Controlled/template.yml")
+	replaceInFile(t, label, "  color: '#066fc5'\n  name: Version Controlled\n", "  name: Version Controlled\n  color: '#066fc5'\n")
+	if err := diff(flags); err != nil {
+		t.Fatalf("Unexpected error diffing unchanged templates: %v", err)
+	}
+
+	replaceInFile(t, filepath.Join(dir, "CheckThreshold/CPU Usage/query.flux"), `r["_field"] == "usage_user"`, `r["_field"] == "usage_system"`)
+	if err := os.RemoveAll(filepath.Join(dir, "Task")); err != nil {
+		t.Fatalf("Unable to remove task: %v", err)
+	}
+
+	var code exitCode
+	if err := diff(flags); !errors.As(err, &code) || code != 1 {
+		t.Errorf("Expected exit code 1, got: %v", err)
+	}
+}
+
+func TestDiffObjects(t *testing.T) {
+	ex := extract.Builtin()
+
+	remote, err := loadObjects("testdata/split/multiple-template", nil, nil, ex, true)
+	if err != nil {
+		t.Fatalf("Unable to load remote objects: %v", err)
+	}
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/multiple-template", dir)
+	replaceInFile(t, filepath.Join(dir, "CheckThreshold/CPU Usage/query.flux"), `"usage_user"`, `"usage_system"`)
+	if err := os.RemoveAll(filepath.Join(dir, "Task")); err != nil {
+		t.Fatalf("Unable to remove task: %v", err)
+	}
+	copyDir(t, "testdata/split/single-variable", dir)
+
+	local, err := loadObjects(dir, nil, nil, ex, true)
+	if err != nil {
+		t.Fatalf("Unable to load local objects: %v", err)
+	}
+
+	diffs, err := diffObjects(remote, local, ex)
+	if err != nil {
+		t.Fatalf("Unexpected error comparing objects: %v", err)
+	}
+
+	statuses := map[string]string{}
+	for _, d := range diffs {
+		statuses[d.Kind+"/"+d.Name] = d.Status
+	}
+	exp := map[string]string{
+		"CheckThreshold/naughty-sutherland-8af003": statusModified,
+		"Dashboard/eager-cori-839000":              statusUnchanged,
+		"Label/cool-ride-8cd001":                   statusUnchanged,
+		"Task/random-potato-263400":                statusRemoved,
+		"Variable/quirky-wiles-1d2001":             statusAdded,
+	}
+	if diff := cmp.Diff(exp, statuses); diff != "" {
+		t.Errorf("Unexpected statuses:\n%s", diff)
+	}
+
+	for _, d := range diffs {
+		if d.Status != statusModified {
+			continue
+		}
+		if len(d.Diffs) != 1 || d.Diffs[0].File != "CheckThreshold/CPU Usage/query.flux" {
+			t.Errorf("Expected only the check's query to differ, got: %+v", d.Diffs)
+		}
+	}
+}
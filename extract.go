@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadExtractors returns the builtin extractors along with any declared
+// in the rules file, if one is given.
+func loadExtractors(filename string) (extract.Set, error) {
+	ex := extract.Builtin()
+	if filename == "" {
+		return ex, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read extractors file %q: %v", filename, err)
+	}
+
+	var rules []extractorRule
+	if err := yaml.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("unable to decode extractors file %q: %v", filename, err)
+	}
+
+	for i, r := range rules {
+		e, err := r.extractor()
+		if err != nil {
+			return nil, fmt.Errorf("invalid extractor %d in %q: %v", i, filename, err)
+		}
+		ex.Register(r.Kind, e)
+	}
+
+	return ex, nil
+}
+
+// An extractorRule declares a node to extract using a path expression,
+// e.g. spec.charts[].queries[].query, where [] walks each item in a list.
+type extractorRule struct {
+	Kind string `yaml:"kind"`
+	Path string `yaml:"path"`
+	Name string `yaml:"name"`
+	Ext  string `yaml:"ext"`
+}
+
+func (r extractorRule) extractor() (extract.Extractor, error) {
+	if r.Kind == "" {
+		return nil, errors.New("kind is required")
+	}
+	if r.Name == "" {
+		return nil, errors.New("name is required")
+	}
+
+	ext := r.Ext
+	if ext == "" {
+		ext = extract.FluxExt
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	return extract.NewPath(r.Path, r.Name, ext)
+}
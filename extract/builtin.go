@@ -0,0 +1,135 @@
+package extract
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	Register("CheckDeadman", Func(walkCheck))
+	Register("CheckThreshold", Func(walkCheck))
+	Register("Dashboard", Func(walkDashboard))
+	Register("NotificationRule", Func(walkRule))
+	Register("Task", Func(walkTask))
+	Register("Telegraf", Func(walkTelegraf))
+	Register("Variable", Func(walkVariable))
+}
+
+// walkDashboard walks a dashboard spec, and finds all of the query and note nodes.
+// We name each node after the chart it is in, using the chart name
+// and type. If a chart has multiple queries, or two charts have the same
+// name and type, the names will not be unique.
+func walkDashboard(spec *yaml.Node) []Node {
+	var extracted []Node
+
+	// The query nodes can be found at spec.charts[].queries[].query
+	// where a [] indicates there is an array of charts/queries.
+	charts := walkNode(spec, "charts").Content
+	for _, c := range charts {
+		queries := walkNode(c, "queries").Content
+		var nodes []*yaml.Node
+		for _, q := range queries {
+			nodes = append(nodes, walkNode(q, "query"))
+		}
+
+		chartName := walkNode(c, "name").Value
+		chartKind := walkNode(c, "kind").Value
+		name := fmt.Sprintf("%s_%s", chartName, chartKind)
+		for _, node := range nodes {
+			extracted = append(extracted, Node{Name: name, Ext: FluxExt, Node: node})
+		}
+
+		// Markdown cells keep their text in the note, but any chart can
+		// have one, so extract it wherever it is set.
+		if note := walkNode(c, "note"); note.Value != "" {
+			extracted = append(extracted, Node{Name: name, Ext: MarkdownExt, Node: note})
+		}
+	}
+
+	return extracted
+}
+
+// walkTask walks a task spec, and finds the query node.
+// This returns a list to match the other walk function, but will only
+// ever contain one member.
+func walkTask(spec *yaml.Node) []Node {
+	return []Node{{
+		Name: "query",
+		Ext:  FluxExt,
+		Node: walkNode(spec, "query"),
+	}}
+}
+
+// walkCheck walks a threshold or deadman check spec and finds the query
+// and status message template nodes.
+// The message uses ${ } for its own interpolation, which is left untouched
+// when it is rendered as a go template.
+func walkCheck(spec *yaml.Node) []Node {
+	nodes := []Node{{
+		Name: "query",
+		Ext:  FluxExt,
+		Node: walkNode(spec, "query"),
+	}}
+
+	if msg := walkNode(spec, "statusMessageTemplate"); msg.Value != "" {
+		nodes = append(nodes, Node{Name: "message", Ext: MessageExt, Node: msg})
+	}
+
+	return nodes
+}
+
+// walkVariable walks a variable spec and finds the query node.
+// Only variables of the query type have a query, so the list
+// will be empty for any other variable.
+func walkVariable(spec *yaml.Node) []Node {
+	if walkNode(spec, "type").Value != "query" {
+		return nil
+	}
+
+	return []Node{{
+		Name: "query",
+		Ext:  FluxExt,
+		Node: walkNode(spec, "query"),
+	}}
+}
+
+// walkRule walks a notification rule spec and finds the message template node.
+// Like a check's status message, it uses ${ } for its own interpolation.
+func walkRule(spec *yaml.Node) []Node {
+	msg := walkNode(spec, "messageTemplate")
+	if msg.Value == "" {
+		return nil
+	}
+
+	return []Node{{
+		Name: "message",
+		Ext:  MessageExt,
+		Node: msg,
+	}}
+}
+
+// walkTelegraf walks a telegraf spec and finds the config node,
+// which is written out as a toml file.
+func walkTelegraf(spec *yaml.Node) []Node {
+	return []Node{{
+		Name: "config",
+		Ext:  TOMLExt,
+		Node: walkNode(spec, "config"),
+	}}
+}
+
+// walkNode will walk a node's children, looking for the value
+// node that matches the key.
+func walkNode(node *yaml.Node, key string) *yaml.Node {
+	// Within a node's content, nodes are grouped in pairs.
+	// The first node in a pair is a scalar string node, with the key as value.
+	// The second node in the pair is the value.
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return &yaml.Node{}
+}
@@ -0,0 +1,105 @@
+// Package extract finds the nodes in a template object's spec, such as flux
+// queries, which influxdb-stack-manager moves out into their own files when
+// splitting a template, and puts back when uniting it.
+//
+// Extractors for extra kinds or fields can be added by other Go tools with
+// Register, from an init function, and will then be used by any Set returned
+// from Builtin.
+package extract
+
+import (
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File extensions used for the different types of extracted content.
+const (
+	FluxExt     = ".flux"
+	MarkdownExt = ".md"
+	MessageExt  = ".tmpl"
+	TOMLExt     = ".toml"
+)
+
+// A Node contains the name for the node, generated from the chart/task/check
+// it belongs to, the extension of the file it is extracted to, and a pointer
+// to the node so it may be updated. The node does not have to hold flux,
+// e.g. telegraf configs are extracted in the same way.
+type Node struct {
+	Name string
+	Ext  string
+	Node *yaml.Node
+}
+
+// An Extractor finds the nodes in an object's spec which should be moved
+// out into their own files. Split and unite both use the same extractors,
+// so they always agree on which nodes are externalised.
+type Extractor interface {
+	Extract(spec *yaml.Node) []Node
+}
+
+// A Func allows a plain function to be used as an Extractor.
+type Func func(spec *yaml.Node) []Node
+
+// Extract calls f.
+func (f Func) Extract(spec *yaml.Node) []Node {
+	return f(spec)
+}
+
+// A Set holds the extractors to use for each kind. A kind can have more
+// than one, in which case the nodes from each are combined.
+type Set map[string][]Extractor
+
+// Register adds an extractor for the kind.
+func (s Set) Register(kind string, e Extractor) {
+	s[kind] = append(s[kind], e)
+}
+
+// Nodes returns all of the nodes to be extracted from the spec of an object
+// of the kind. A node found by more than one extractor is only returned the
+// first time, so it is only extracted once.
+func (s Set) Nodes(kind string, spec *yaml.Node) []Node {
+	var nodes []Node
+	seen := map[*yaml.Node]bool{}
+	for _, e := range s[kind] {
+		for _, n := range e.Extract(spec) {
+			if !seen[n.Node] {
+				seen[n.Node] = true
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes
+}
+
+var (
+	mu      sync.Mutex
+	builtin = Set{}
+)
+
+// Register adds an extractor for the kind to the builtin set, which split
+// and unite always use.
+func Register(kind string, e Extractor) {
+	mu.Lock()
+	defer mu.Unlock()
+	builtin.Register(kind, e)
+}
+
+// Nodes returns all of the nodes that the builtin set extracts from the spec
+// of an object of the kind.
+func Nodes(kind string, spec *yaml.Node) []Node {
+	return Builtin().Nodes(kind, spec)
+}
+
+// Builtin returns a copy of the builtin set, which more extractors can be
+// added to without changing it.
+func Builtin() Set {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := Set{}
+	for kind, es := range builtin {
+		s[kind] = append([]Extractor(nil), es...)
+	}
+	return s
+}
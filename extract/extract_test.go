@@ -0,0 +1,27 @@
+package extract
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSetNodesOverlapping(t *testing.T) {
+	var spec yaml.Node
+	if err := yaml.Unmarshal([]byte(`query: 'from(bucket: "a")'`), &spec); err != nil {
+		t.Fatalf("Unexpected error decoding spec: %v", err)
+	}
+
+	// A rule for a node which a builtin extractor already finds doesn't
+	// extract it again.
+	s := Builtin()
+	e, err := NewPath("spec.query", "query", FluxExt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Register("Task", e)
+
+	if nodes := s.Nodes("Task", spec.Content[0]); len(nodes) != 1 {
+		t.Errorf("Expected the query to be extracted once, got %+v", nodes)
+	}
+}
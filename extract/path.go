@@ -0,0 +1,83 @@
+package extract
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NewPath returns an Extractor for the nodes found with a path expression,
+// e.g. spec.charts[].queries[].query, where [] walks each item in a list.
+// All of the nodes are given the same name, and split adds a numerical
+// suffix to any duplicates.
+func NewPath(expr, name, ext string) (Extractor, error) {
+	path, err := parsePath(expr)
+	if err != nil {
+		return nil, err
+	}
+	return pathExtractor{path: path, name: name, ext: ext}, nil
+}
+
+// A pathElem is a single step in a path expression.
+type pathElem struct {
+	key  string
+	each bool
+}
+
+// parsePath parses a path expression. Paths are always relative to the
+// object, and so must start with spec.
+func parsePath(expr string) ([]pathElem, error) {
+	parts := strings.Split(expr, ".")
+	if len(parts) < 2 || parts[0] != "spec" {
+		return nil, fmt.Errorf("path %q must start with spec.", expr)
+	}
+
+	var path []pathElem
+	for _, p := range parts[1:] {
+		el := pathElem{key: strings.TrimSuffix(p, "[]")}
+		el.each = el.key != p
+		if el.key == "" || strings.ContainsAny(el.key, "[]") {
+			return nil, fmt.Errorf("invalid element %q in path %q", p, expr)
+		}
+		path = append(path, el)
+	}
+
+	return path, nil
+}
+
+// A pathExtractor extracts every non-empty string found at its path.
+type pathExtractor struct {
+	path []pathElem
+	name string
+	ext  string
+}
+
+func (p pathExtractor) Extract(spec *yaml.Node) []Node {
+	nodes := []*yaml.Node{spec}
+	for _, el := range p.path {
+		var next []*yaml.Node
+		for _, n := range nodes {
+			if n.Kind != yaml.MappingNode {
+				continue
+			}
+
+			v := walkNode(n, el.key)
+			switch {
+			case el.each && v.Kind == yaml.SequenceNode:
+				next = append(next, v.Content...)
+			case !el.each && v.Kind != 0:
+				next = append(next, v)
+			}
+		}
+		nodes = next
+	}
+
+	var extracted []Node
+	for _, n := range nodes {
+		if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!str" && n.Value != "" {
+			extracted = append(extracted, Node{Name: p.name, Ext: p.ext, Node: n})
+		}
+	}
+	return extracted
+}
@@ -0,0 +1,74 @@
+package extract
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParsePath(t *testing.T) {
+	for expr, exp := range map[string][]pathElem{
+		"spec.query": {{key: "query"}},
+		"spec.charts[].queries[].query": {
+			{key: "charts", each: true},
+			{key: "queries", each: true},
+			{key: "query"},
+		},
+		"query":             nil,
+		"metadata.name":     nil,
+		"spec.":             nil,
+		"spec.charts[0]":    nil,
+		"spec.charts..name": nil,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			path, err := parsePath(expr)
+			if exp == nil {
+				if err == nil {
+					t.Errorf("Expected an error, got path: %v", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(exp, path, cmp.AllowUnexported(pathElem{})); diff != "" {
+				t.Errorf("Unexpected path:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPathExtractor(t *testing.T) {
+	var spec yaml.Node
+	err := yaml.Unmarshal([]byte(`
+charts:
+  - name: a
+    queries:
+      - query: 'from(bucket: "a")'
+      - query: 'from(bucket: "b")'
+  - name: b
+    queries: not a list
+  - name: c
+    queries:
+      - query: 10
+`), &spec)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding spec: %v", err)
+	}
+
+	e, err := NewPath("spec.charts[].queries[].query", "query", FluxExt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nodes := e.Extract(spec.Content[0])
+
+	var values []string
+	for _, n := range nodes {
+		values = append(values, n.Node.Value)
+	}
+	exp := []string{`from(bucket: "a")`, `from(bucket: "b")`}
+	if diff := cmp.Diff(exp, values); diff != "" {
+		t.Errorf("Unexpected nodes extracted:\n%s", diff)
+	}
+}
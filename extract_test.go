@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractorsFile(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "extractors.yml")
+	err := os.WriteFile(rules, []byte(`
+- kind: Dashboard
+  path: spec.description
+  name: description
+  ext: md
+`), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write extractors file: %v", err)
+	}
+
+	src := filepath.Join(dir, "templates")
+	if err := split([]string{"testdata/united/multiple-template/template.yml", src, "--extractors", rules}); err != nil {
+		t.Fatalf("Unexpected error splitting template: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(src, "Dashboard/Test Dashboard/description.md"))
+	if err != nil {
+		t.Fatalf("Expected description to be extracted: %v", err)
+	}
+	if s := string(b); s != "With a new fancy description!" {
+		t.Errorf("Unexpected description extracted: %q", s)
+	}
+
+	b, err = os.ReadFile(filepath.Join(src, "Dashboard/Test Dashboard", templateFile))
+	if err != nil {
+		t.Fatalf("Unable to read template: %v", err)
+	}
+	if !strings.Contains(string(b), "description: file://description.md") {
+		t.Errorf("Expected description to reference the extracted file, got:\n%s", b)
+	}
+
+	dest := filepath.Join(dir, "template.yml")
+	if err := unite([]string{src, dest, "--extractors", rules, "--allow-external-refs"}); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+	testUniteOutput(t, "multiple-template", dest)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// templateFuncs are the functions available in templates and extracted files,
+// on top of those built in to text/template. Where it makes sense, the value
+// being worked on is the last argument, so that they can be used in pipelines.
+var templateFuncs = template.FuncMap{
+	"default":  defaultValue,
+	"duration": duration,
+	"env":      os.Getenv,
+	"indent":   indent,
+	"join":     join,
+	"lower":    strings.ToLower,
+	"quote":    quote,
+	"required": required,
+	"secret":   secretRef,
+	"toYaml":   toYAML,
+	"upper":    strings.ToUpper,
+}
+
+// defaultValue returns the value, or def if the value is empty. Templates are
+// executed with missingkey=error, so a field missing from the data fails
+// before it gets here, and must be looked up with index instead.
+// For example: {{ index . "Retention" | default "30d" }}
+func defaultValue(def, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+// required returns the value, or fails with the message if it is empty.
+// For example: {{ .Host | required "Host must be set" }}
+func required(msg string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, errors.New(msg)
+	}
+	return value, nil
+}
+
+// isEmpty returns whether the value is nil, or the zero value of its type,
+// or an empty slice or map.
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// quote returns the value as a double quoted string, which is safe to use
+// as a value in yaml, and as a string literal in flux. Flux interpolates ${ }
+// within strings, and \$ isn't a valid escape in yaml, so it is left as it is.
+// For example: name: {{ .Name | quote }}
+func quote(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fmt.Sprint(value)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// toYAML returns the value encoded as yaml, without a trailing newline.
+// For example, at the start of a line: {{ .Thresholds | toYaml | indent 4 }}
+func toYAML(value interface{}) (string, error) {
+	b, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// indent adds the number of spaces to the start of every line of the text.
+// For example, at the start of a line: {{ .Thresholds | toYaml | indent 4 }}
+func indent(spaces int, text string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(text, "\n", "\n"+pad)
+}
+
+// join joins the items of a list into a string, separated by sep.
+// For example: {{ .Hosts | join "|" }}
+func join(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join expects a list, got %T", list)
+	}
+
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(items, sep), nil
+}
+
+// duration adds up one or more durations, such as "1h", "-5m" or "30d",
+// allowing for simple arithmetic. As well as the units go accepts, days and
+// weeks can be used, as in flux, but not months or years, as their length
+// varies. The result is written in a form that both templates and flux
+// accept. For example: every: {{ duration .Every "30s" }}
+func duration(values ...interface{}) (time.Duration, error) {
+	var total time.Duration
+	for _, value := range values {
+		switch v := value.(type) {
+		case time.Duration:
+			total += v
+
+		case string:
+			d, err := parseDuration(v)
+			if err != nil {
+				return 0, err
+			}
+			total += d
+
+		default:
+			return 0, fmt.Errorf("duration expects strings like \"1h30m\", got %T", value)
+		}
+	}
+	return total, nil
+}
+
+// dayUnits matches the days and weeks in a duration, which go doesn't accept.
+var dayUnits = regexp.MustCompile(`([0-9]*\.?[0-9]+)([dw])`)
+
+// parseDuration parses a duration as time.ParseDuration does, also accepting
+// days and weeks, by turning them into hours.
+func parseDuration(s string) (time.Duration, error) {
+	var err error
+	hours := dayUnits.ReplaceAllStringFunc(s, func(unit string) string {
+		m := dayUnits.FindStringSubmatch(unit)
+		n, perr := strconv.ParseFloat(m[1], 64)
+		if perr != nil {
+			err = perr
+			return unit
+		}
+		if m[2] == "w" {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if err != nil {
+		return 0, fmt.Errorf("time: invalid duration %q", s)
+	}
+
+	d, err := time.ParseDuration(hours)
+	if err != nil {
+		return 0, fmt.Errorf("time: invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	os.Setenv("STACK_MANAGER_TEST_REGION", "eu-west")
+	defer os.Unsetenv("STACK_MANAGER_TEST_REGION")
+
+	data := map[string]interface{}{
+		"Empty":   "",
+		"Name":    "CPU: \"high\"",
+		"Zero":    0,
+		"Every":   "1h",
+		"Hosts":   []interface{}{"a", "b", "c"},
+		"Levels":  map[string]interface{}{"crit": 90, "warn": 75},
+		"Servers": []string{"x", "y"},
+	}
+
+	for name, tc := range map[string]struct {
+		template string
+		exp      string
+		err      string
+	}{
+		"default empty":      {template: `{{ .Empty | default "fallback" }}`, exp: "fallback"},
+		"default zero":       {template: `{{ .Zero | default 5 }}`, exp: "5"},
+		"default set":        {template: `{{ .Every | default "5m" }}`, exp: "1h"},
+		"default missing":    {template: `{{ index . "Missing" | default "none" }}`, exp: "none"},
+		"required set":       {template: `{{ .Every | required "Every must be set" }}`, exp: "1h"},
+		"required empty":     {template: `{{ .Empty | required "Empty must be set" }}`, err: "Empty must be set"},
+		"env":                {template: `{{ env "STACK_MANAGER_TEST_REGION" }}`, exp: "eu-west"},
+		"env unset":          {template: `{{ env "STACK_MANAGER_TEST_UNSET" | default "none" }}`, exp: "none"},
+		"quote":              {template: `{{ .Name | quote }}`, exp: `"CPU: \"high\""`},
+		"quote number":       {template: `{{ quote 5 }}`, exp: `"5"`},
+		"quote flux ${":      {template: `{{ quote "${r.host}" }}`, exp: `"${r.host}"`},
+		"toYaml":             {template: `{{ .Levels | toYaml }}`, exp: "crit: 90\nwarn: 75"},
+		"indent":             {template: `{{ .Levels | toYaml | indent 2 }}`, exp: "  crit: 90\n  warn: 75"},
+		"join":               {template: `{{ .Hosts | join "|" }}`, exp: "a|b|c"},
+		"join strings":       {template: `{{ .Servers | join ", " }}`, exp: "x, y"},
+		"join not a list":    {template: `{{ .Every | join "," }}`, err: "join expects a list"},
+		"duration":           {template: `{{ duration .Every }}`, exp: "1h0m0s"},
+		"duration sum":       {template: `{{ duration .Every "-15m" "30s" }}`, exp: "45m30s"},
+		"duration nested":    {template: `{{ duration (duration .Every) "1h" }}`, exp: "2h0m0s"},
+		"duration days":      {template: `{{ duration "1w" "-1d" "12h" }}`, exp: "156h0m0s"},
+		"duration invalid":   {template: `{{ duration "soon" }}`, err: "invalid duration"},
+		"duration months":    {template: `{{ duration "1mo" }}`, err: "invalid duration"},
+		"lower":              {template: `{{ .Name | lower }}`, exp: `cpu: "high"`},
+		"upper":              {template: `{{ upper "cpu" }}`, exp: "CPU"},
+		"secret":             {template: `{{ secret "slack-token" }}`, exp: `{secretRef: {key: "slack-token"}}`},
+		"missing still errs": {template: `{{ .Missing | default "none" }}`, err: "map has no entry"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(tc.template)
+			if err != nil {
+				t.Fatalf("Unable to parse template: %v", err)
+			}
+
+			var out strings.Builder
+			err = tmpl.Execute(&out, data)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.exp, out.String()); diff != "" {
+				t.Errorf("Unexpected output:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTemplateFuncsInFiles(t *testing.T) {
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/single-task", dir)
+
+	// Functions can be used in both the template and extracted files.
+	task := filepath.Join(dir, "Task")
+	entries, err := os.ReadDir(task)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single task, got %v: %v", entries, err)
+	}
+	task = filepath.Join(task, entries[0].Name())
+	if err := os.WriteFile(filepath.Join(task, "query.flux"), []byte(`from(bucket: {{ .Bucket | quote }})`), 0644); err != nil {
+		t.Fatalf("Unable to write query: %v", err)
+	}
+	replaceInFile(t, filepath.Join(task, "template.yml"), "name: ", "name: {{ upper \"x\" }}")
+
+	objs, err := loadObjects(dir, map[string]interface{}{"Bucket": "my-bucket"}, nil, extract.Builtin(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error loading objects: %v", err)
+	}
+	if q := walkNode(&objs[0].Spec, "query").Value; q != `from(bucket: "my-bucket")` {
+		t.Errorf("Unexpected query: %q", q)
+	}
+	if !strings.HasPrefix(objs[0].name(), "X") {
+		t.Errorf("Expected the template to be executed with functions, got name %q", objs[0].name())
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultHost is the address used if no host is configured, matching the influx cli.
+const defaultHost = "http://localhost:8086"
+
+// An httpBackend talks to the influxdb v2 API directly, without needing the
+// influx cli to be installed.
+type httpBackend struct {
+	client *http.Client
+	host   string
+	token  string
+	org    string
+	orgID  string
+	dryRun bool
+
+	// Used to confirm changes before they are applied.
+	in  io.Reader
+	out io.Writer
+
+	// Where dry runs are written.
+	stderr io.Writer
+}
+
+// newHTTPBackend creates an httpBackend from the config, falling back to the
+// same environment variables as the influx cli for any unset values.
+func newHTTPBackend(cfg config) (*httpBackend, error) {
+	if cfg.activeConfig != "" || cfg.configsPath != "" {
+		return nil, errors.New("the http backend does not support influx cli configs, use --host, --org and --token instead")
+	}
+
+	b := &httpBackend{
+		client: http.DefaultClient,
+		host:   firstNonEmpty(cfg.host, os.Getenv("INFLUX_HOST"), defaultHost),
+		token:  firstNonEmpty(cfg.token, os.Getenv("INFLUX_TOKEN")),
+		org:    firstNonEmpty(cfg.org, os.Getenv("INFLUX_ORG")),
+		orgID:  firstNonEmpty(cfg.orgID, os.Getenv("INFLUX_ORG_ID")),
+		dryRun: cfg.dryRun,
+		in:     os.Stdin,
+		out:    cfg.stdout(),
+		stderr: cfg.stderr(),
+	}
+	b.host = strings.TrimSuffix(b.host, "/")
+
+	if cfg.skipVerify {
+		b.client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	return b, nil
+}
+
+func (b *httpBackend) export(stackID string) (io.Reader, error) {
+	return b.exportTemplate(exportRequest{StackID: stackID})
+}
+
+func (b *httpBackend) exportFiltered(filter exportFilter) (io.Reader, error) {
+	var req exportRequest
+	for _, r := range filter.resources {
+		req.Resources = append(req.Resources, exportResource{Kind: r.Kind, ID: r.ResourceID})
+	}
+
+	// Labels and kinds filter all of the resources in the organization.
+	if len(filter.labels) > 0 || len(filter.kinds) > 0 {
+		orgID, err := b.resolveOrgID()
+		if err != nil {
+			return nil, err
+		}
+
+		org := exportOrg{OrgID: orgID}
+		org.ResourceFilters.ByLabel = filter.labels
+		org.ResourceFilters.ByResourceKind = filter.kinds
+		req.OrgIDs = []exportOrg{org}
+	}
+
+	return b.exportTemplate(req)
+}
+
+// exportTemplate exports a template, converting it to yaml.
+func (b *httpBackend) exportTemplate(req exportRequest) (io.Reader, error) {
+	if b.dryRun {
+		b.logDryRun(http.MethodPost, "/api/v2/templates/export", req)
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	if err := b.do(http.MethodPost, "/api/v2/templates/export", req, &out); err != nil {
+		return nil, err
+	}
+
+	// The API returns the template as json, so convert it to
+	// the yaml that the influx cli would give us.
+	var buf bytes.Buffer
+	if err := jsonToYAML(&out, &buf); err != nil {
+		return nil, fmt.Errorf("unable to convert exported template: %v", err)
+	}
+
+	return &buf, nil
+}
+
+func (b *httpBackend) apply(stackID, filename, force string, secrets map[string]string) error {
+	req, err := b.applyRequest(stackID, filename, secrets)
+	if err != nil {
+		return err
+	}
+	if b.dryRun {
+		b.logDryRun(http.MethodPost, "/api/v2/templates/apply", req.redacted())
+		return nil
+	}
+
+	// The changes are checked first. Without --force, they are shown and
+	// must be confirmed. With --force true, nothing is confirmed, so only
+	// templates which don't change any existing resource are applied, and
+	// --force conflict is needed to change them without confirmation.
+	switch force {
+	case "", "true", "conflict":
+	default:
+		return fmt.Errorf("unknown --force %q, expected 'true' or 'conflict'", force)
+	}
+	if force != "conflict" {
+		req.DryRun = true
+		var summary applyResponse
+		if err := b.do(http.MethodPost, "/api/v2/templates/apply", req, &summary); err != nil {
+			return err
+		}
+
+		if force == "" {
+			summary.print(b.out)
+			if !confirm(b.in, b.out, "Confirm application of the above resources (y/n): ") {
+				return errors.New("aborted application of template")
+			}
+		} else if changed := summary.changed(); len(changed) > 0 {
+			return fmt.Errorf("the template would change existing resources:\n  %s\nSet --force conflict to apply changes to existing resources without confirmation", strings.Join(changed, "\n  "))
+		}
+		req.DryRun = false
+	}
+
+	var summary applyResponse
+	if err := b.do(http.MethodPost, "/api/v2/templates/apply", req, &summary); err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, "Stack ID: %s\n", summary.StackID)
+	return nil
+}
+
+func (b *httpBackend) summarize(stackID, filename string, secrets map[string]string) (string, error) {
+	req, err := b.applyRequest(stackID, filename, secrets)
+	if err != nil {
+		return "", err
+	}
+	req.DryRun = true
+	if b.dryRun {
+		b.logDryRun(http.MethodPost, "/api/v2/templates/apply", req.redacted())
+		return "", nil
+	}
+
+	var summary applyResponse
+	if err := b.do(http.MethodPost, "/api/v2/templates/apply", req, &summary); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	summary.print(&buf)
+	return buf.String(), nil
+}
+
+// applyRequest builds the request to apply the template in the file to a stack.
+func (b *httpBackend) applyRequest(stackID, filename string, secrets map[string]string) (applyRequest, error) {
+	contents, err := readTemplateContents(filename)
+	if err != nil {
+		return applyRequest{}, err
+	}
+
+	orgID, err := b.resolveOrgID()
+	if err != nil {
+		return applyRequest{}, err
+	}
+
+	return applyRequest{
+		OrgID:    orgID,
+		StackID:  stackID,
+		Template: applyTemplate{Contents: contents},
+		Secrets:  secrets,
+	}, nil
+}
+
+func (b *httpBackend) listStacks() ([]stack, error) {
+	orgID, err := b.resolveOrgID()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Stacks []stack `json:"stacks"`
+	}
+	path := "/api/v2/stacks?orgID=" + url.QueryEscape(orgID)
+	if b.dryRun {
+		b.logDryRun(http.MethodGet, path, nil)
+		return nil, nil
+	}
+	err = b.do(http.MethodGet, path, nil, &resp)
+	return resp.Stacks, err
+}
+
+func (b *httpBackend) getStack(stackID string) (stack, error) {
+	path := "/api/v2/stacks/" + url.PathEscape(stackID)
+	if b.dryRun {
+		b.logDryRun(http.MethodGet, path, nil)
+		return stack{ID: stackID}, nil
+	}
+
+	var s stack
+	err := b.do(http.MethodGet, path, nil, &s)
+	return s, err
+}
+
+func (b *httpBackend) initStack(name, description string) (stack, error) {
+	orgID, err := b.resolveOrgID()
+	if err != nil {
+		return stack{}, err
+	}
+
+	req := map[string]string{
+		"orgID":       orgID,
+		"name":        name,
+		"description": description,
+	}
+	if b.dryRun {
+		b.logDryRun(http.MethodPost, "/api/v2/stacks", req)
+		return stack{}, nil
+	}
+
+	var s stack
+	err = b.do(http.MethodPost, "/api/v2/stacks", req, &s)
+	return s, err
+}
+
+func (b *httpBackend) addResources(stackID string, resources []stackResource) error {
+	req := map[string][]stackResource{"additionalResources": resources}
+	path := "/api/v2/stacks/" + url.PathEscape(stackID)
+	if b.dryRun {
+		b.logDryRun(http.MethodPatch, path, req)
+		return nil
+	}
+	return b.do(http.MethodPatch, path, req, nil)
+}
+
+func (b *httpBackend) deleteStack(stackID string) error {
+	orgID, err := b.resolveOrgID()
+	if err != nil {
+		return err
+	}
+
+	path := "/api/v2/stacks/" + url.PathEscape(stackID) + "?orgID=" + url.QueryEscape(orgID)
+	if b.dryRun {
+		b.logDryRun(http.MethodDelete, path, nil)
+		return nil
+	}
+	return b.do(http.MethodDelete, path, nil, nil)
+}
+
+// An exportRequest is the body sent to the template export endpoint. It
+// selects either a stack, or resources by org filters and ID.
+type exportRequest struct {
+	StackID   string           `json:"stackID,omitempty"`
+	OrgIDs    []exportOrg      `json:"orgIDs,omitempty"`
+	Resources []exportResource `json:"resources,omitempty"`
+}
+
+type exportOrg struct {
+	OrgID           string `json:"orgID"`
+	ResourceFilters struct {
+		ByLabel        []string `json:"byLabel,omitempty"`
+		ByResourceKind []string `json:"byResourceKind,omitempty"`
+	} `json:"resourceFilters"`
+}
+
+type exportResource struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// An applyRequest is the body sent to the template apply endpoint.
+type applyRequest struct {
+	DryRun   bool              `json:"dryRun"`
+	OrgID    string            `json:"orgID"`
+	StackID  string            `json:"stackID,omitempty"`
+	Template applyTemplate     `json:"template"`
+	Secrets  map[string]string `json:"secrets,omitempty"`
+}
+
+// redacted returns a copy of the request with the values of its secrets hidden.
+func (r applyRequest) redacted() applyRequest {
+	if len(r.Secrets) == 0 {
+		return r
+	}
+	secrets := map[string]string{}
+	for k := range r.Secrets {
+		secrets[k] = redacted
+	}
+	r.Secrets = secrets
+	return r
+}
+
+type applyTemplate struct {
+	Contents []interface{} `json:"contents"`
+}
+
+// An applyResponse holds the parts of the template apply response that we use.
+type applyResponse struct {
+	StackID string                 `json:"stackID"`
+	Diff    map[string][]diffEntry `json:"diff"`
+}
+
+type diffEntry struct {
+	Kind             string    `json:"kind"`
+	StateStatus      string    `json:"stateStatus"`
+	TemplateMetaName string    `json:"templateMetaName"`
+	New              diffState `json:"new"`
+	Old              diffState `json:"old"`
+}
+
+// A diffState is the state of a resource on one side of a diff. The whole
+// state is kept, to tell whether the two sides differ.
+type diffState struct {
+	Name string
+	raw  interface{}
+}
+
+func (s *diffState) UnmarshalJSON(b []byte) error {
+	var state struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	s.Name = state.Name
+	return json.Unmarshal(b, &s.raw)
+}
+
+// changed returns the resources which already exist in influxdb, and would
+// be changed by the apply, as kind and name.
+func (r applyResponse) changed() []string {
+	var changed []string
+	for _, es := range r.Diff {
+		for _, e := range es {
+			if e.Kind != "" && e.StateStatus == "exists" && e.Old.raw != nil && !reflect.DeepEqual(e.Old.raw, e.New.raw) {
+				changed = append(changed, e.Kind+"/"+e.TemplateMetaName)
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// print writes a line for each resource that would be changed by the apply.
+func (r applyResponse) print(w io.Writer) {
+	var entries []diffEntry
+	for _, es := range r.Diff {
+		for _, e := range es {
+			// Some entries, such as label mappings, are not resources.
+			if e.Kind != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].TemplateMetaName < entries[j].TemplateMetaName
+	})
+
+	for _, e := range entries {
+		name := firstNonEmpty(e.New.Name, e.Old.Name)
+		fmt.Fprintf(w, "%-8s %-28s %-32s %s\n", e.StateStatus, e.Kind, e.TemplateMetaName, name)
+	}
+}
+
+// resolveOrgID returns the ID of the configured organisation, looking it
+// up by name if only the name was given.
+func (b *httpBackend) resolveOrgID() (string, error) {
+	if b.orgID != "" {
+		return b.orgID, nil
+	}
+	if b.org == "" {
+		return "", errors.New("must specify either --org or --org-id for the http backend")
+	}
+	if b.dryRun {
+		return "<" + b.org + ">", nil
+	}
+
+	var resp struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	path := "/api/v2/orgs?org=" + url.QueryEscape(b.org)
+	if err := b.do(http.MethodGet, path, nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Orgs) == 0 {
+		return "", fmt.Errorf("organization %q not found", b.org)
+	}
+
+	b.orgID = resp.Orgs[0].ID
+	return b.orgID, nil
+}
+
+// do sends a request to the API, encoding body as json. The response is
+// copied to out if it is an io.Writer, otherwise it is decoded as json.
+func (b *httpBackend) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to encode request: %v", err)
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, b.host+path, r)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Token "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(msg, &apiErr); err == nil && apiErr.Message != "" {
+			return fmt.Errorf("%s %s failed: %s: %s", method, path, apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if w, ok := out.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode response from %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+func (b *httpBackend) logDryRun(method, path string, body interface{}) {
+	fmt.Fprintln(b.stderr, "Dry run - calling:")
+	fmt.Fprintln(b.stderr, method, b.host+path)
+	if body == nil {
+		return
+	}
+	buf, err := json.MarshalIndent(body, "", "  ")
+	if err == nil {
+		fmt.Fprintln(b.stderr, string(buf))
+	}
+}
+
+// readTemplateContents reads all of the objects from a yaml template file,
+// so they can be sent as json.
+func readTemplateContents(filename string) ([]interface{}, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open template %q: %v", filename, err)
+	}
+	defer f.Close()
+
+	var contents []interface{}
+	dec := yaml.NewDecoder(f)
+	for {
+		var obj interface{}
+		if err := dec.Decode(&obj); err != nil {
+			if errors.Is(err, io.EOF) {
+				return contents, nil
+			}
+			return nil, fmt.Errorf("unable to decode template %q: %v", filename, err)
+		}
+		contents = append(contents, obj)
+	}
+}
+
+// jsonToYAML converts a json array of objects into a stream of yaml documents.
+// The json is decoded as yaml (which it is a subset of) so that the key order
+// is kept.
+func jsonToYAML(r io.Reader, w io.Writer) error {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.SequenceNode {
+		return errors.New("expected a json array of objects")
+	}
+
+	// The encoder fails to close if nothing has been encoded,
+	// which happens for stacks with no resources.
+	if len(doc.Content[0].Content) == 0 {
+		return nil
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, obj := range doc.Content[0].Content {
+		resetStyle(obj)
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// resetStyle clears the style of a node and all of its children, so json
+// flow style objects and quoted strings are written as regular yaml.
+func resetStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		resetStyle(n)
+	}
+}
+
+// firstNonEmpty returns the first of the values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeInflux is a stand-in for the influxdb API, serving the united test
+// template for the given stack and recording any applied templates.
+// Without a template, every stack is exported as empty. Filtered exports
+// are given the whole template.
+type fakeInflux struct {
+	mu       sync.Mutex
+	t        *testing.T
+	stackID  string
+	template string
+	applied  []applyRequest
+	summary  string // returned for dry runs, if set
+	exports  []exportRequest
+	stacks   map[string]*stack
+	patches  []stackResource
+}
+
+// pushed returns the applied templates that weren't dry runs.
+func (f *fakeInflux) pushed() []applyRequest {
+	var pushed []applyRequest
+	for _, req := range f.applied {
+		if !req.DryRun {
+			pushed = append(pushed, req)
+		}
+	}
+	return pushed
+}
+
+func newFakeInflux(t *testing.T, stackID, template string) (*fakeInflux, *httptest.Server) {
+	f := &fakeInflux{t: t, stackID: stackID, template: template, stacks: map[string]*stack{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Token my-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"code":"unauthorized","message":"unauthorized access"}`))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/v2/stacks") {
+		f.serveStacks(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v2/templates/export":
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.t.Errorf("unable to decode export request: %v", err)
+		}
+		f.exports = append(f.exports, req)
+		if f.template == "" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		// Filtered exports get the whole template.
+		if req.StackID != f.stackID && req.StackID != "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not found","message":"stack not found"}`))
+			return
+		}
+
+		contents, err := readTemplateContents(f.template)
+		if err != nil {
+			f.t.Fatalf("unable to read template: %v", err)
+		}
+		json.NewEncoder(w).Encode(contents)
+
+	case "/api/v2/orgs":
+		if r.URL.Query().Get("org") != "my-org" {
+			w.Write([]byte(`{"orgs":[]}`))
+			return
+		}
+		w.Write([]byte(`{"orgs":[{"id":"0123456789abcdef"}]}`))
+
+	case "/api/v2/templates/apply":
+		var req applyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.t.Errorf("unable to decode apply request: %v", err)
+		}
+		f.applied = append(f.applied, req)
+		if req.DryRun && f.summary != "" {
+			w.Write([]byte(f.summary))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"stackID": req.StackID})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeInflux) serveStacks(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v2/stacks" {
+		switch r.Method {
+		case http.MethodGet:
+			var stacks []stack
+			for _, s := range f.stacks {
+				stacks = append(stacks, *s)
+			}
+			json.NewEncoder(w).Encode(map[string][]stack{"stacks": stacks})
+
+		case http.MethodPost:
+			var req struct {
+				OrgID string `json:"orgID"`
+				Name  string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				f.t.Errorf("unable to decode stack request: %v", err)
+			}
+			if req.OrgID != "0123456789abcdef" {
+				f.t.Errorf("unexpected org ID %q", req.OrgID)
+			}
+			s := &stack{ID: "new-stack-id", Events: []stackEvent{{Name: req.Name}}}
+			f.stacks[s.ID] = s
+			json.NewEncoder(w).Encode(s)
+		}
+		return
+	}
+
+	s, ok := f.stacks[strings.TrimPrefix(r.URL.Path, "/api/v2/stacks/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"not found","message":"stack not found"}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodPatch:
+		var req struct {
+			AdditionalResources []stackResource `json:"additionalResources"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.t.Errorf("unable to decode stack update: %v", err)
+		}
+		f.patches = append(f.patches, req.AdditionalResources...)
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		delete(f.stacks, s.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestHTTPPull(t *testing.T) {
+	_, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	dir := t.TempDir()
+	err := pull([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir})
+	if err != nil {
+		t.Fatalf("Unexpected error pulling template: %v", err)
+	}
+
+	compareDirs(t, dir, filepath.Join("testdata/split/multiple-template"))
+}
+
+func TestHTTPPullErrors(t *testing.T) {
+	_, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	for name, tc := range map[string]struct {
+		args []string
+		err  string
+	}{
+		"unknown stack": {
+			args: []string{"other-id", "--token", "my-token"},
+			err:  "stack not found",
+		},
+		"bad token": {
+			args: []string{"stack-id", "--token", "bad-token"},
+			err:  "unauthorized access",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := append(tc.args, "--backend", "http", "--host", srv.URL, "-d", t.TempDir())
+			err := pull(args)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Expected error containing %q, got: %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHTTPPush(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "")
+
+	// Pushing records a snapshot in the directory, so use a copy.
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/multiple-template", dir)
+
+	err := push([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token",
+		"--org", "my-org", "--force", "true", "-d", dir, "--allow-external-refs"})
+	if err != nil {
+		t.Fatalf("Unexpected error pushing template: %v", err)
+	}
+
+	if len(f.pushed()) != 1 {
+		t.Fatalf("Expected 1 template to be applied, got %d", len(f.pushed()))
+	}
+	req := f.pushed()[0]
+	if req.DryRun || req.StackID != "stack-id" || req.OrgID != "0123456789abcdef" {
+		t.Errorf("Unexpected apply request: dryRun=%v stackID=%q orgID=%q", req.DryRun, req.StackID, req.OrgID)
+	}
+
+	var names []string
+	for _, obj := range req.Template.Contents {
+		names = append(names, getItemName(obj))
+	}
+	sort.Strings(names)
+
+	exp := []string{"cool-ride-8cd001", "eager-cori-839000", "naughty-sutherland-8af003", "random-potato-263400"}
+	if diff := cmp.Diff(exp, names); diff != "" {
+		t.Errorf("Unexpected objects applied:\n%s", diff)
+	}
+}
+
+func TestHTTPPushConfirm(t *testing.T) {
+	for answer, applied := range map[string]int{"y\n": 2, "n\n": 1} {
+		t.Run(strings.TrimSpace(answer), func(t *testing.T) {
+			f, srv := newFakeInflux(t, "stack-id", "")
+
+			b, err := newHTTPBackend(config{host: srv.URL, token: "my-token", orgID: "0123456789abcdef"})
+			if err != nil {
+				t.Fatalf("Unexpected error creating backend: %v", err)
+			}
+			b.in = strings.NewReader(answer)
+			b.out = &strings.Builder{}
+
+			err = b.apply("stack-id", "testdata/united/single-label/template.yml", "", nil)
+			if (err == nil) != (applied == 2) {
+				t.Errorf("Unexpected error result: %v", err)
+			}
+			if len(f.applied) != applied {
+				t.Fatalf("Expected %d requests, got %d", applied, len(f.applied))
+			}
+			if !f.applied[0].DryRun {
+				t.Errorf("Expected the first request to be a dry run")
+			}
+		})
+	}
+}
+
+func TestHTTPPushConflicts(t *testing.T) {
+	const summary = `{"stackID": "stack-id", "diff": {"labels": [
+		{"kind": "Label", "stateStatus": "exists", "templateMetaName": "cool-ride-8cd001",
+			"new": {"name": "Version Controlled", "color": "#066fc5"},
+			"old": {"name": "Version Controlled", "color": "#ffffff"}},
+		{"kind": "Label", "stateStatus": "exists", "templateMetaName": "same",
+			"new": {"name": "Same"}, "old": {"name": "Same"}},
+		{"kind": "Label", "stateStatus": "new", "templateMetaName": "added",
+			"new": {"name": "Added"}}
+	]}}`
+
+	for force, pushed := range map[string]int{"": 1, "true": 0, "conflict": 1, "yes": 0} {
+		t.Run(force, func(t *testing.T) {
+			f, srv := newFakeInflux(t, "stack-id", "")
+			f.summary = summary
+
+			b, err := newHTTPBackend(config{host: srv.URL, token: "my-token", orgID: "0123456789abcdef"})
+			if err != nil {
+				t.Fatalf("Unexpected error creating backend: %v", err)
+			}
+			out := &strings.Builder{}
+			b.in, b.out = strings.NewReader("y\n"), out
+
+			err = b.apply("stack-id", "testdata/united/single-label/template.yml", force, nil)
+			switch force {
+			case "":
+				// The changes are shown and confirmed, so may be applied.
+				if err != nil {
+					t.Errorf("Unexpected error applying confirmed changes: %v", err)
+				}
+				if !strings.Contains(out.String(), "cool-ride-8cd001") {
+					t.Errorf("Expected the changes to be shown, got:\n%s", out)
+				}
+			case "true":
+				if err == nil || !strings.Contains(err.Error(), "Label/cool-ride-8cd001") || strings.Contains(err.Error(), "Label/same") {
+					t.Errorf("Expected an error for the changed label, got: %v", err)
+				}
+			case "conflict":
+				if err != nil {
+					t.Errorf("Unexpected error changing existing resources: %v", err)
+				}
+				if len(f.applied) != 1 {
+					t.Errorf("Expected no dry run, got %d requests", len(f.applied))
+				}
+			default:
+				if err == nil || !strings.Contains(err.Error(), "unknown --force") {
+					t.Errorf("Expected an error for an unknown --force, got: %v", err)
+				}
+			}
+			if len(f.pushed()) != pushed {
+				t.Errorf("Expected %d templates to be applied, got %d", pushed, len(f.pushed()))
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 )
@@ -13,14 +14,20 @@ Usage:
   influxdb-stack-manager [command] [flags]
 
 Available Commands:
+  apply		Apply a plan made by the plan command.
+  data		Print the merged data that templates are united with.
+  diff		Compare the template directory with a stack in influxdb.
+  plan		Save the changes a push would make to a plan file for review.
   pull		Fetch a stack template from influxdb and split it.
   push		Apply templates changes to a stack in influxdb.
+  rollback	Roll a stack back to the backup taken before a push.
   split		Split a local template file.
+  stacks	Create and manage stacks in influxdb.
+  status	Show which resources have changed since the last pull or push.
   unite		Unite a set of parsed templates to generate a local template file.
 
 Flags:
-  -h,		Help for the influx command
-`
+  -h,		Help for the influx command`
 
 func main() {
 	log.SetFlags(0)
@@ -35,15 +42,36 @@ func run(args []string) {
 
 	var err error
 	switch args[0] {
+	case "apply":
+		err = apply(args[1:])
+
+	case "data":
+		err = data(args[1:])
+
+	case "diff":
+		err = diff(args[1:])
+
+	case "plan":
+		err = plan(args[1:])
+
 	case "pull":
 		err = pull(args[1:])
 
 	case "push":
 		err = push(args[1:])
 
+	case "rollback":
+		err = rollback(args[1:])
+
 	case "split":
 		err = split(args[1:])
 
+	case "stacks":
+		err = stacks(args[1:])
+
+	case "status":
+		err = status(args[1:])
+
 	case "unite":
 		err = unite(args[1:])
 
@@ -51,6 +79,10 @@ func run(args []string) {
 		log.Println(usage)
 	}
 
+	var code exitCode
+	if errors.As(err, &code) {
+		os.Exit(int(code))
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the project manifest, looked for in the working directory.
+const manifestFile = "stack-manager.yml"
+
+// A manifest declares the environments a project's templates are pushed to,
+// so that their settings don't have to be passed to every command.
+type manifest struct {
+	Environments map[string]environment `yaml:"environments"`
+}
+
+// An environment holds the settings for a single stack. Any paths are
+// relative to the manifest.
+type environment struct {
+	StackID      string   `yaml:"stackID"`
+	ActiveConfig string   `yaml:"activeConfig"`
+	ConfigsPath  string   `yaml:"configsPath"`
+	Host         string   `yaml:"host"`
+	Org          string   `yaml:"org"`
+	OrgID        string   `yaml:"orgID"`
+	SkipVerify   bool     `yaml:"skipVerify"`
+	Backend      string   `yaml:"backend"`
+	DataFile     string   `yaml:"dataFile"`
+	DataFiles    []string `yaml:"dataFiles"`
+	Directory    string   `yaml:"directory"`
+	Extractors   string   `yaml:"extractors"`
+	SecretsFile  string   `yaml:"secretsFile"`
+}
+
+// parse parses the flags, then fills in any that weren't set from the
+// environment chosen with --env.
+func (cfg *config) parse(fs *pflag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cfg.env == "" || cfg.help {
+		return nil
+	}
+
+	m, err := loadManifest(cfg.manifest)
+	if err != nil {
+		return err
+	}
+	env, ok := m.Environments[cfg.env]
+	if !ok {
+		return fmt.Errorf("environment %q not found in %q, expected one of: %s", cfg.env, cfg.manifest, strings.Join(m.names(), ", "))
+	}
+
+	cfg.applyEnv(fs, env, filepath.Dir(cfg.manifest))
+	return nil
+}
+
+// applyEnv sets each config value from the environment, unless its flag was set.
+func (cfg *config) applyEnv(fs *pflag.FlagSet, env environment, root string) {
+	path := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(root, p)
+	}
+
+	for flag, v := range map[string]struct {
+		dest  *string
+		value string
+	}{
+		"active-config": {&cfg.activeConfig, env.ActiveConfig},
+		"configs-path":  {&cfg.configsPath, path(env.ConfigsPath)},
+		"host":          {&cfg.host, env.Host},
+		"org":           {&cfg.org, env.Org},
+		"org-id":        {&cfg.orgID, env.OrgID},
+		"backend":       {&cfg.backend, env.Backend},
+		"directory":     {&cfg.directory, path(env.Directory)},
+		"extractors":    {&cfg.extractors, path(env.Extractors)},
+		"secrets-file":  {&cfg.secretsFile, path(env.SecretsFile)},
+	} {
+		if v.value != "" && !fs.Changed(flag) {
+			*v.dest = v.value
+		}
+	}
+
+	if !fs.Changed("data-file") {
+		for _, f := range append([]string{env.DataFile}, env.DataFiles...) {
+			if f != "" {
+				cfg.data.files = append(cfg.data.files, path(f))
+			}
+		}
+	}
+
+	if env.SkipVerify && !fs.Changed("skip-verify") {
+		cfg.skipVerify = true
+	}
+
+	// A stack ID given as an argument still takes precedence.
+	cfg.envStackID = env.StackID
+}
+
+// loadManifest reads the project manifest.
+func loadManifest(filename string) (manifest, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return manifest{}, fmt.Errorf("--env is set, but no manifest was found at %q", filename)
+		}
+		return manifest{}, fmt.Errorf("unable to read manifest: %v", err)
+	}
+
+	var m manifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return manifest{}, fmt.Errorf("unable to decode manifest %q: %v", filename, err)
+	}
+	return m, nil
+}
+
+// names returns the names of the environments, in alphabetical order.
+func (m manifest) names() []string {
+	var names []string
+	for name := range m.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifest(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "")
+
+	project := t.TempDir()
+	copyDir(t, "testdata/templated/multiple-template", filepath.Join(project, "templates"))
+	manifest := filepath.Join(project, "stack-manager.yml")
+	err := os.WriteFile(manifest, []byte(`environments:
+  prod:
+    stackID: stack-id
+    host: `+srv.URL+`
+    org: my-org
+    backend: http
+    directory: templates
+    dataFile: templates/data.yml
+`), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write manifest: %v", err)
+	}
+
+	flags := []string{"--env", "prod", "--manifest", manifest, "--token", "my-token", "--force", "true", "--allow-external-refs"}
+	if err := push(flags); err != nil {
+		t.Fatalf("Unexpected error pushing environment: %v", err)
+	}
+	if len(f.pushed()) != 1 {
+		t.Fatalf("Expected 1 template to be applied, got %d", len(f.pushed()))
+	}
+	if req := f.pushed()[0]; req.StackID != "stack-id" || req.OrgID != "0123456789abcdef" || len(req.Template.Contents) != 4 {
+		t.Errorf("Unexpected apply request: stackID=%q orgID=%q objects=%d", req.StackID, req.OrgID, len(req.Template.Contents))
+	}
+
+	// Flags and args override the environment.
+	if err := push(append(flags, "other-id")); err != nil {
+		t.Fatalf("Unexpected error pushing environment: %v", err)
+	}
+	if req := f.pushed()[1]; req.StackID != "other-id" {
+		t.Errorf("Expected the stack ID argument to be used, got %q", req.StackID)
+	}
+	err = push(append(flags, "--org", "other-org"))
+	if err == nil || !strings.Contains(err.Error(), "other-org") {
+		t.Errorf("Expected the org flag to be used, got: %v", err)
+	}
+
+	err = push([]string{"--env", "dev", "--manifest", manifest})
+	if err == nil || !strings.Contains(err.Error(), `environment "dev" not found`) {
+		t.Errorf("Expected an error for an unknown environment, got: %v", err)
+	}
+}
+
+func TestPushEnvs(t *testing.T) {
+	f, srv := newFakeInflux(t, "", "")
+
+	project := t.TempDir()
+	copyDir(t, "testdata/templated/multiple-template", filepath.Join(project, "templates"))
+	manifest := filepath.Join(project, "stack-manager.yml")
+	err := os.WriteFile(manifest, []byte(`environments:
+  eu:
+    stackID: eu-stack
+    org: my-org
+    dataFile: templates/data.yml
+  us:
+    stackID: us-stack
+    org: my-org
+    dataFile: templates/data.json
+  broken:
+    stackID: broken-stack
+    org: missing-org
+    dataFile: templates/data.yml
+`), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write manifest: %v", err)
+	}
+
+	flags := []string{"--manifest", manifest, "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", filepath.Join(project, "templates"), "--allow-external-refs"}
+	if err := push(append(flags, "--all-envs")); err == nil || !strings.Contains(err.Error(), "--force is required") {
+		t.Errorf("Expected an error without --force, got: %v", err)
+	}
+
+	err = push(append(flags, "--all-envs", "--force", "true", "--parallel", "2"))
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 environments failed") {
+		t.Errorf("Expected one environment to fail, got: %v", err)
+	}
+
+	var stacks []string
+	for _, req := range f.pushed() {
+		stacks = append(stacks, req.StackID)
+	}
+	sort.Strings(stacks)
+	if diff := cmp.Diff([]string{"eu-stack", "us-stack"}, stacks); diff != "" {
+		t.Errorf("Unexpected stacks applied:\n%s", diff)
+	}
+
+	f.applied = nil
+	if err := push(append(flags, "--envs", "eu,us", "--force", "true")); err != nil {
+		t.Errorf("Unexpected error pushing to environments: %v", err)
+	}
+	if len(f.pushed()) != 2 {
+		t.Errorf("Expected 2 templates to be applied, got %d", len(f.pushed()))
+	}
+}
+
+func TestPushTargetOutput(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "template.yml")
+	template := strings.Replace(slackTemplate, "%s", "xoxb-123", 1)
+	template = strings.Replace(template, "%s", "hunter2", 1)
+	if err := os.WriteFile(src, []byte(template), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+	dir := t.TempDir()
+	if err := split([]string{src, dir}); err != nil {
+		t.Fatalf("Unexpected error splitting template: %v", err)
+	}
+
+	// When pushing to several environments, everything about each push is
+	// written to its own output, so it is shown under that environment.
+	var out bytes.Buffer
+	cfg := config{directory: dir, influxCmd: "false", backend: "cli", dryRun: true, out: &out}
+	if err := pushTarget(cfg, []string{"stack-id"}, "true"); err != nil {
+		t.Fatalf("Unexpected error in dry run: %v", err)
+	}
+	for _, exp := range []string{"Tempfile", "No value for secret", "Dry run - calling:", "false apply"} {
+		if !strings.Contains(out.String(), exp) {
+			t.Errorf("Expected %q in the output, got:\n%s", exp, out.String())
+		}
+	}
+}
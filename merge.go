@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Markers written around conflicting lines, matching the ones used by git.
+const (
+	conflictLocal  = "<<<<<<< local\n"
+	conflictSep    = "=======\n"
+	conflictRemote = ">>>>>>> remote\n"
+)
+
+// mergeDirs does a three-way merge of the files in the remote directory into the
+// local one, using base as their common ancestor. Files which have only changed
+// on one side take that side's version, and files changed on both are merged line
+// by line, with conflict markers around any lines changed on both sides.
+// Any files only found locally, such as data files, are left alone.
+// It returns the list of files containing conflicts, along with any resource
+// directories whose template was removed while they still hold files of
+// their own, apart from scoped data, as they can't be united without it.
+func mergeDirs(base, local, remote string) ([]string, error) {
+	files := map[string]struct{}{}
+	for _, dir := range []string{base, local, remote} {
+		if err := listFiles(dir, files); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts, removed []string
+	for _, name := range names {
+		b, bok, err := readOptional(filepath.Join(base, name))
+		if err != nil {
+			return nil, err
+		}
+		l, lok, err := readOptional(filepath.Join(local, name))
+		if err != nil {
+			return nil, err
+		}
+		r, rok, err := readOptional(filepath.Join(remote, name))
+		if err != nil {
+			return nil, err
+		}
+
+		filename := filepath.Join(local, name)
+		switch {
+		// Nothing to do if both sides agree, or the remote hasn't changed.
+		case lok == rok && bytes.Equal(l, r):
+		case bok == rok && bytes.Equal(b, r):
+
+		// Only the remote has changed, so take its version.
+		case bok == lok && bytes.Equal(b, l):
+			if err := writeOptional(filename, r, rok); err != nil {
+				return nil, err
+			}
+			if !rok && filepath.Base(name) == templateFile {
+				removed = append(removed, filepath.Dir(filename))
+			}
+
+		// Both have changed, but one side has deleted the file, so keep
+		// whatever local has and let the user decide.
+		case !lok || !rok:
+			conflicts = append(conflicts, filename)
+
+		default:
+			merged, ok := merge3(string(b), string(l), string(r))
+			if !ok {
+				conflicts = append(conflicts, filename)
+			}
+			if err := writeOptional(filename, []byte(merged), true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, dir := range removed {
+		if _, err := os.Stat(dir); err == nil && !isDataOnly(dir) {
+			conflicts = append(conflicts, dir)
+		}
+	}
+	return conflicts, nil
+}
+
+// listFiles adds the path of every file in the directory, relative to it, to
+// the set of files. Our own state is skipped.
+func listFiles(dir string, files map[string]struct{}) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == stateDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = struct{}{}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to list files in %q: %v", dir, err)
+	}
+	return nil
+}
+
+// readOptional reads a file, returning whether it exists.
+func readOptional(filename string) ([]byte, bool, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("unable to read %q: %v", filename, err)
+	}
+	return b, true, nil
+}
+
+// writeOptional writes a file, or removes it (and its directory, if it is then
+// empty) if it shouldn't exist.
+func writeOptional(filename string, b []byte, exists bool) error {
+	if !exists {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to remove %q: %v", filename, err)
+		}
+		// Removing a directory fails if it still has files in it, which is fine.
+		os.Remove(filepath.Dir(filename))
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return fmt.Errorf("unable to make directory for %q: %v", filename, err)
+	}
+	if err := os.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	return nil
+}
+
+// merge3 merges the changes made to base in local and remote, line by line.
+// Where both have changed the same lines differently, both versions are kept
+// between conflict markers, and false is returned.
+func merge3(base, local, remote string) (string, bool) {
+	b, l, r := splitLines(base), splitLines(local), splitLines(remote)
+	ml, mr := matchLines(b, l), matchLines(b, r)
+
+	var out strings.Builder
+	clean := true
+	i, j, k := 0, 0, 0
+	for i < len(b) || j < len(l) || k < len(r) {
+		// Copy any lines which are unchanged on both sides.
+		if i < len(b) && ml[i] == j && mr[i] == k {
+			out.WriteString(b[i])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+
+		// Find the next base line which is kept on both sides. Everything
+		// before it has been changed on at least one side.
+		ni, nj, nk := len(b), len(l), len(r)
+		for n := i; n < len(b); n++ {
+			if ml[n] >= 0 && mr[n] >= 0 {
+				ni, nj, nk = n, ml[n], mr[n]
+				break
+			}
+		}
+
+		bc, lc, rc := b[i:ni], l[j:nj], r[k:nk]
+		switch {
+		case equalLines(bc, lc):
+			writeLines(&out, rc)
+		case equalLines(bc, rc), equalLines(lc, rc):
+			writeLines(&out, lc)
+		default:
+			clean = false
+			writeMarker(&out, conflictLocal)
+			writeLines(&out, lc)
+			writeMarker(&out, conflictSep)
+			writeLines(&out, rc)
+			writeMarker(&out, conflictRemote)
+		}
+		i, j, k = ni, nj, nk
+	}
+
+	return out.String(), clean
+}
+
+// splitLines splits the text into lines, keeping the line endings.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines finds the longest common subsequence of lines in a and b.
+// It returns, for each line in a, the index of the line it matches in b,
+// or -1 if it was removed.
+func matchLines(a, b []string) []int {
+	// lengths[i][j] holds the length of the LCS of a[i:] and b[j:].
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	matches := make([]int, len(a))
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case j < len(b) && a[i] == b[j]:
+			matches[i] = j
+			i, j = i+1, j+1
+		case j < len(b) && lengths[i][j+1] > lengths[i+1][j]:
+			j++
+		default:
+			matches[i] = -1
+			i++
+		}
+	}
+	return matches
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *strings.Builder, lines []string) {
+	for _, l := range lines {
+		out.WriteString(l)
+	}
+}
+
+// writeMarker writes a conflict marker, making sure it starts on a new line.
+func writeMarker(out *strings.Builder, marker string) {
+	if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		out.WriteString("\n")
+	}
+	out.WriteString(marker)
+}
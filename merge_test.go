@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	for name, tc := range map[string]struct {
+		local, remote string
+		exp           string
+		clean         bool
+	}{
+		"unchanged": {
+			local: base, remote: base,
+			exp: base, clean: true,
+		},
+		"local change": {
+			local: "a\nB\nc\nd\ne\n", remote: base,
+			exp: "a\nB\nc\nd\ne\n", clean: true,
+		},
+		"remote change": {
+			local: base, remote: "a\nb\nc\nD\ne\n",
+			exp: "a\nb\nc\nD\ne\n", clean: true,
+		},
+		"separate changes": {
+			local: "a\nB\nc\nd\ne\n", remote: "a\nb\nc\nD\ne\nf\n",
+			exp: "a\nB\nc\nD\ne\nf\n", clean: true,
+		},
+		"same change": {
+			local: "a\nb\nC\nd\ne\n", remote: "a\nb\nC\nd\ne\n",
+			exp: "a\nb\nC\nd\ne\n", clean: true,
+		},
+		"inserts and deletes": {
+			local: "a\nx\nb\nc\nd\ne\n", remote: "a\nb\nc\ne\n",
+			exp: "a\nx\nb\nc\ne\n", clean: true,
+		},
+		"conflict": {
+			local: "a\nb\nL\nd\ne\n", remote: "a\nb\nR\nd\ne\n",
+			exp:   "a\nb\n<<<<<<< local\nL\n=======\nR\n>>>>>>> remote\nd\ne\n",
+			clean: false,
+		},
+		"conflict without newline": {
+			local: "a\nb\nc\nd\nL", remote: "a\nb\nc\nd\nR",
+			exp:   "a\nb\nc\nd\n<<<<<<< local\nL\n=======\nR\n>>>>>>> remote\n",
+			clean: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			merged, clean := merge3(base, tc.local, tc.remote)
+			if diff := cmp.Diff(tc.exp, merged); diff != "" {
+				t.Errorf("Unexpected merge result:\n%s", diff)
+			}
+			if clean != tc.clean {
+				t.Errorf("Expected clean=%v, got %v", tc.clean, clean)
+			}
+		})
+	}
+}
+
+func TestPullMerge(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+	dir := t.TempDir()
+	flags := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir}
+
+	if err := pull(append(flags, "--merge")); err == nil {
+		t.Errorf("Expected an error merging without a previous pull")
+	}
+	if err := pull(flags); err != nil {
+		t.Fatalf("Unexpected error pulling template: %v", err)
+	}
+
+	// Template a value, and add a file of our own.
+	check := filepath.Join(dir, "CheckThreshold/CPU Usage/template.yml")
+	replaceInFile(t, check, "value: 80", "value: {{ .Thresholds.CPU }}")
+	readme := filepath.Join(dir, "README.md")
+	if err := os.WriteFile(readme, []byte("# Templates\n"), 0644); err != nil {
+		t.Fatalf("Unable to write readme: %v", err)
+	}
+
+	// Change other parts of the check and the dashboard in influxdb.
+	remote := filepath.Join(t.TempDir(), "template.yml")
+	copyFile(t, f.template, remote)
+	replaceInFile(t, remote, "every: 1m0s", "every: 5m0s")
+	replaceInFile(t, remote, "With a new fancy description!", "An even newer description")
+	f.template = remote
+
+	if err := pull(append(flags, "--merge")); err != nil {
+		t.Fatalf("Unexpected error merging template: %v", err)
+	}
+
+	b, err := os.ReadFile(check)
+	if err != nil {
+		t.Fatalf("Unable to read check: %v", err)
+	}
+	for _, s := range []string{"value: {{ .Thresholds.CPU }}", "every: 5m0s"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("Expected check template to contain %q, got:\n%s", s, b)
+		}
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "Dashboard/Test Dashboard/template.yml"))
+	if err != nil || !strings.Contains(string(b), "An even newer description") {
+		t.Errorf("Expected the dashboard to be updated, got: %v\n%s", err, b)
+	}
+	if _, err := os.Stat(readme); err != nil {
+		t.Errorf("Expected readme to be kept: %v", err)
+	}
+
+	// Changing the same line on both sides is a conflict.
+	replaceInFile(t, check, "every: 5m0s", "every: 10m0s")
+	replaceInFile(t, remote, "every: 5m0s", "every: 15m0s")
+	err = pull(append(flags, "--merge"))
+	if err == nil || !strings.Contains(err.Error(), check) {
+		t.Fatalf("Expected a conflict in %q, got: %v", check, err)
+	}
+
+	b, err = os.ReadFile(check)
+	if err != nil {
+		t.Fatalf("Unable to read check: %v", err)
+	}
+	exp := conflictLocal + "  every: 10m0s\n" + conflictSep + "  every: 15m0s\n" + conflictRemote
+	if !strings.Contains(string(b), exp) {
+		t.Errorf("Expected conflict markers in check template, got:\n%s", b)
+	}
+}
+
+func TestPullMergeRemovedResource(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+	dir := t.TempDir()
+	flags := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir}
+
+	if err := pull(flags); err != nil {
+		t.Fatalf("Unexpected error pulling template: %v", err)
+	}
+
+	// Add a file of our own to the dashboard, and data to the check.
+	dashboard := filepath.Join(dir, "Dashboard/Test Dashboard")
+	if err := os.WriteFile(filepath.Join(dashboard, "notes.md"), []byte("# Notes\n"), 0644); err != nil {
+		t.Fatalf("Unable to write notes: %v", err)
+	}
+	check := filepath.Join(dir, "CheckThreshold/CPU Usage")
+	if err := os.WriteFile(filepath.Join(check, scopedDataFile), []byte("Threshold: 80\n"), 0644); err != nil {
+		t.Fatalf("Unable to write data: %v", err)
+	}
+
+	// Then remove everything but the task in influxdb.
+	f.template = "testdata/united/single-task/template.yml"
+
+	// The dashboard can't be united without its template, so is a
+	// conflict, while the check's data is simply kept.
+	err := pull(append(flags, "--merge"))
+	if err == nil || !strings.Contains(err.Error(), dashboard) || strings.Contains(err.Error(), check) {
+		t.Fatalf("Expected a conflict for %q only, got: %v", dashboard, err)
+	}
+	if _, err := os.Stat(filepath.Join(dashboard, templateFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the dashboard's template to be removed, got: %v", err)
+	}
+	if !isDataOnly(check) {
+		t.Errorf("Expected only the check's data to be kept")
+	}
+}
+
+func replaceInFile(t *testing.T, filename, old, new string) {
+	t.Helper()
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unable to read %q: %v", filename, err)
+	}
+	if !strings.Contains(string(b), old) {
+		t.Fatalf("%q not found in %q", old, filename)
+	}
+	s := strings.Replace(string(b), old, new, 1)
+	if err := os.WriteFile(filename, []byte(s), 0644); err != nil {
+		t.Fatalf("unable to write %q: %v", filename, err)
+	}
+}
+
+func copyFile(t *testing.T, src, dest string) {
+	t.Helper()
+
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("unable to read %q: %v", src, err)
+	}
+	if err := os.WriteFile(dest, b, 0644); err != nil {
+		t.Fatalf("unable to write %q: %v", dest, err)
+	}
+}
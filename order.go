@@ -0,0 +1,239 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// kindPriority is used to order objects which have no dependencies
+// between them, so the united template is stable and reads in a natural
+// order. Higher numbers are added first, and unknown kinds are added last.
+var kindPriority = map[string]int{
+	kindLabel:             9,
+	kindBucket:            8,
+	kindEndpointHTTP:      7,
+	kindEndpointPagerDuty: 7,
+	kindEndpointSlack:     7,
+	kindCheck:             6,
+	kindDeadman:           5,
+	kindRule:              4,
+	kindTask:              3,
+	kindVariable:          2,
+	kindDashboard:         1,
+}
+
+// orderObjects sorts the objects so that each one comes after everything it
+// depends on. Dependencies come from the associations in the spec, the
+// endpoint a notification rule sends to, and relationships between kinds:
+// labels come before everything, buckets before variables and tasks, and
+// notification endpoints before rules.
+// An error is returned if the dependencies contain a cycle, or if an object
+// refers to another which is not in the template, unless external is set, as
+// it may already exist in influxdb.
+func orderObjects(objs []object, external bool) ([]object, error) {
+	byID := map[string][]int{}
+	byKind := map[string][]int{}
+	for i := range objs {
+		byID[objs[i].id()] = append(byID[objs[i].id()], i)
+		byKind[objs[i].Kind] = append(byKind[objs[i].Kind], i)
+	}
+
+	// dependents[j] holds the indexes of the objects that depend on objs[j],
+	// and pending[i] counts the dependencies of objs[i] not yet ordered.
+	dependents := make([][]int, len(objs))
+	pending := make([]int, len(objs))
+	depend := func(i int, deps []int) {
+		for _, j := range deps {
+			if i != j {
+				dependents[j] = append(dependents[j], i)
+				pending[i]++
+			}
+		}
+	}
+
+	for i := range objs {
+		obj := &objs[i]
+		for _, a := range walkNode(&obj.Spec, "associations").Content {
+			id := walkNode(a, "kind").Value + "/" + walkNode(a, "name").Value
+			if len(byID[id]) == 0 && !external {
+				return nil, fmt.Errorf("%s is associated with %s, which is not in the template", obj.id(), id)
+			}
+			depend(i, byID[id])
+		}
+
+		if obj.Kind == kindRule {
+			name := walkNode(&obj.Spec, "endpointName").Value
+			found := false
+			for kind := range byKind {
+				if isEndpoint(kind) && len(byID[kind+"/"+name]) > 0 {
+					depend(i, byID[kind+"/"+name])
+					found = true
+				}
+			}
+			if !found && !external {
+				return nil, fmt.Errorf("%s sends to endpoint %q, which is not in the template", obj.id(), name)
+			}
+		}
+
+		for kind, deps := range byKind {
+			if dependsOnKind(obj.Kind, kind) {
+				depend(i, deps)
+			}
+		}
+	}
+
+	// Repeatedly take the first object, by priority, that has all of
+	// its dependencies ordered.
+	ready := &readyObjects{objs: objs}
+	for i := range objs {
+		if pending[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+
+	ordered := make([]object, 0, len(objs))
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		ordered = append(ordered, objs[i])
+		for _, j := range dependents[i] {
+			if pending[j]--; pending[j] == 0 {
+				heap.Push(ready, j)
+			}
+		}
+	}
+
+	if len(ordered) < len(objs) {
+		var found []string
+		for _, c := range cycles(objs, dependents, pending) {
+			found = append(found, strings.Join(c, ", "))
+		}
+		return nil, fmt.Errorf("dependency cycle detected between: %s", strings.Join(found, "; "))
+	}
+
+	return ordered, nil
+}
+
+// cycles returns the ids of the objects in each cycle among those which are
+// still pending, as found by Tarjan's strongly connected components
+// algorithm. Objects which only wait on a cycle aren't part of it, so are
+// left out.
+func cycles(objs []object, dependents [][]int, pending []int) [][]string {
+	index := make([]int, len(objs))
+	low := make([]int, len(objs))
+	onStack := make([]bool, len(objs))
+	var stack []int
+	var found [][]string
+	next := 1
+
+	var connect func(i int)
+	connect = func(i int) {
+		index[i], low[i] = next, next
+		next++
+		stack = append(stack, i)
+		onStack[i] = true
+
+		for _, j := range dependents[i] {
+			if pending[j] == 0 {
+				continue
+			}
+			if index[j] == 0 {
+				connect(j)
+				if low[j] < low[i] {
+					low[i] = low[j]
+				}
+			} else if onStack[j] && index[j] < low[i] {
+				low[i] = index[j]
+			}
+		}
+
+		if low[i] != index[i] {
+			return
+		}
+		var component []string
+		for {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[j] = false
+			component = append(component, objs[j].id())
+			if j == i {
+				break
+			}
+		}
+		// Objects never depend on themselves, so a cycle has at least two.
+		if len(component) > 1 {
+			sort.Strings(component)
+			found = append(found, component)
+		}
+	}
+
+	for i := range objs {
+		if pending[i] > 0 && index[i] == 0 {
+			connect(i)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i][0] < found[j][0] })
+	return found
+}
+
+// readyObjects is a heap of the indexes of objects which are ready to be
+// ordered, with the one to take next first.
+type readyObjects struct {
+	objs    []object
+	indexes []int
+}
+
+func (r *readyObjects) Len() int {
+	return len(r.indexes)
+}
+
+func (r *readyObjects) Less(i, j int) bool {
+	a, b := &r.objs[r.indexes[i]], &r.objs[r.indexes[j]]
+	if kindPriority[a.Kind] != kindPriority[b.Kind] {
+		return kindPriority[a.Kind] > kindPriority[b.Kind]
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.name() != b.name() {
+		return a.name() < b.name()
+	}
+	return r.indexes[i] < r.indexes[j]
+}
+
+func (r *readyObjects) Swap(i, j int) {
+	r.indexes[i], r.indexes[j] = r.indexes[j], r.indexes[i]
+}
+
+func (r *readyObjects) Push(x interface{}) {
+	r.indexes = append(r.indexes, x.(int))
+}
+
+func (r *readyObjects) Pop() interface{} {
+	i := r.indexes[len(r.indexes)-1]
+	r.indexes = r.indexes[:len(r.indexes)-1]
+	return i
+}
+
+// dependsOnKind returns whether an object of the kind depends on all objects
+// of the dep kind.
+func dependsOnKind(kind, dep string) bool {
+	switch {
+	case dep == kindLabel:
+		return kind != kindLabel
+
+	case dep == kindBucket:
+		return kind == kindVariable || kind == kindTask
+
+	case isEndpoint(dep):
+		return kind == kindRule
+	}
+
+	return false
+}
+
+// isEndpoint returns whether the kind is one of the notification endpoints.
+func isEndpoint(kind string) bool {
+	return strings.HasPrefix(kind, "NotificationEndpoint")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+const planUsage = `Plan the changes that pushing the template directory would make.
+
+The directory is united, and influxdb is asked what applying it to the stack
+would change, without applying it. The template is saved to a plan file along
+with the summary of the changes, and hashes of the directory and of the stack,
+ready to be applied with the apply command once it has been reviewed.
+
+This is only supported by the http backend.
+
+Usage:
+  influxdb-stack-manager plan [<stack-id>] [flags]
+
+If no stack-id is given, the one saved in the template directory is used.
+
+Flags:
+`
+
+const applyUsage = `Apply a plan made by the plan command to its stack.
+
+The template saved in the plan is applied exactly as it is. If the template
+directory or the stack in influxdb have changed since the plan was made, it is
+not applied, and a new plan needs to be made. Like push, the stack is backed
+up before the plan is applied.
+
+Usage:
+  influxdb-stack-manager apply <plan-file> [flags]
+
+Flags:
+`
+
+// A savedPlan is a united template saved for review, along with what is
+// needed to check that nothing has changed by the time it is applied.
+type savedPlan struct {
+	StackID    string   `json:"stackID"`
+	Directory  string   `json:"directory"`
+	DataFiles  []string `json:"dataFiles,omitempty"`
+	Extractors string   `json:"extractors,omitempty"`
+
+	// Hashes of the template directory, along with the data and
+	// extractors files, and of the stack exported from influxdb.
+	LocalHash  string `json:"localHash"`
+	RemoteHash string `json:"remoteHash"`
+
+	Summary      string `json:"summary"`
+	Template     string `json:"template"`
+	TemplateHash string `json:"templateHash"`
+}
+
+func plan(args []string) error {
+	var cfg config
+	var out string
+
+	fs := cfg.flagSet()
+	cfg.data.flags(fs)
+	fs.BoolVar(&cfg.external, "allow-external-refs", false, "Allow associations and notification endpoints which are not in the template, as they already exist in influxdb.")
+	fs.StringVar(&out, "out", "stack.plan", "File to save the plan to.")
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager plan -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(planUsage + fs.FlagUsages())
+		return nil
+	}
+
+	// The influx cli can only show the changes as part of its confirmation
+	// prompt, so check before uniting anything.
+	if cfg.backend != "http" {
+		return fmt.Errorf("Error: plan is only supported by the http backend, set --backend http\nSee 'influxdb-stack-manager plan -h' for help")
+	}
+
+	stackID, err := cfg.stackID(fs.Args())
+	if err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager plan -h' for help", err)
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	ex, err := loadExtractors(cfg.extractors)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	p := savedPlan{StackID: stackID, Directory: cfg.directory, DataFiles: cfg.data.files, Extractors: cfg.extractors}
+	if p.LocalHash, err = p.hashLocal(); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	tmpFile, err := writeTemplateToFile(cfg.directory, cfg.data, ex, cfg.external)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	template, err := os.ReadFile(tmpFile)
+	if err != nil {
+		return fmt.Errorf("Error: unable to read template: %v", err)
+	}
+	p.Template = string(template)
+	p.TemplateHash = hashBytes(template)
+
+	if p.RemoteHash, err = hashRemote(b, stackID); err != nil {
+		return err
+	}
+	secrets, err := cfg.secrets(tmpFile)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if p.Summary, err = b.summarize(stackID, tmpFile, secrets); err != nil {
+		return fmt.Errorf("Error: unable to summarize changes: %v", err)
+	}
+	if cfg.dryRun {
+		return nil
+	}
+
+	if err := p.write(out); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	fmt.Print(p.Summary)
+	log.Printf("Plan saved to %q, apply it with:\n  influxdb-stack-manager apply %s", out, out)
+	return nil
+}
+
+func apply(args []string) error {
+	var cfg config
+	fs := cfg.flagSet()
+	fs.BoolVar(&cfg.noBackup, "no-backup", false, "Don't back up the stack before applying the plan to it.")
+	fs.StringVar(&cfg.backupDir, "backup-dir", "", "Directory to save backups in, if not the one in the plan's template directory.")
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager apply -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(applyUsage + fs.FlagUsages())
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Error: required arg missing: plan-file\nSee 'influxdb-stack-manager apply -h' for help")
+	}
+
+	p, err := readPlan(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	// Backups are kept with the directory that the plan was made from.
+	cfg.directory = p.Directory
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// Check that what was reviewed is still what would be pushed.
+	local, err := p.hashLocal()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if local != p.LocalHash {
+		return fmt.Errorf("Error: %q has changed since the plan was made, make a new plan", p.Directory)
+	}
+
+	remote, err := hashRemote(b, p.StackID)
+	if err != nil {
+		return err
+	}
+	if remote != p.RemoteHash && !cfg.dryRun {
+		return fmt.Errorf("Error: stack %s has changed in influxdb since the plan was made, make a new plan", p.StackID)
+	}
+
+	f, err := os.CreateTemp("", "*.yml")
+	if err != nil {
+		return fmt.Errorf("Error: unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.WriteString(f, p.Template); err != nil {
+		return fmt.Errorf("Error: unable to write template: %v", err)
+	}
+
+	// Secrets are never saved in the plan, so are only read now.
+	secrets, err := cfg.secrets(f.Name())
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// Save what is in influxdb first, so that it can be rolled back to.
+	if _, err := backupStack(b, cfg, p.StackID); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// The plan has already been reviewed, and nothing has changed since,
+	// so don't ask again, or refuse the changes to existing resources.
+	if err := b.apply(p.StackID, f.Name(), "conflict", secrets); err != nil {
+		return err
+	}
+	if cfg.dryRun {
+		return nil
+	}
+
+	if err := writeSnapshot(p.Directory, p.Directory); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	return nil
+}
+
+// readPlan reads a plan file, checking that its template hasn't been edited.
+func readPlan(filename string) (savedPlan, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return savedPlan{}, fmt.Errorf("unable to read plan: %v", err)
+	}
+
+	var p savedPlan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return savedPlan{}, fmt.Errorf("unable to decode plan %q: %v", filename, err)
+	}
+	if hashBytes([]byte(p.Template)) != p.TemplateHash {
+		return savedPlan{}, fmt.Errorf("the template in plan %q doesn't match its hash", filename)
+	}
+	return p, nil
+}
+
+func (p savedPlan) write(filename string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode plan: %v", err)
+	}
+	if err := os.WriteFile(filename, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write plan: %v", err)
+	}
+	return nil
+}
+
+// hashLocal returns a hash of everything used to unite the template:
+// the resources in the directory, and the data and extractors files.
+func (p savedPlan) hashLocal() (string, error) {
+	resources, err := hashResources(p.Directory)
+	if err != nil {
+		return "", err
+	}
+
+	var dirs []string
+	for d := range resources {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	// Scoped data files are left out of the resources' hashes, so they
+	// are hashed along with the other files.
+	scoped, err := scopedDataFiles(p.Directory)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, d := range dirs {
+		fmt.Fprintf(h, "%s:%s\n", d, resources[d])
+	}
+	for _, filename := range append(append(scoped, p.DataFiles...), p.Extractors) {
+		if filename == "" {
+			continue
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %q: %v", filename, err)
+		}
+		fmt.Fprintf(h, "%s:%s\n", filename, hashBytes(b))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashRemote returns a hash of the template exported from the stack.
+func hashRemote(b backend, stackID string) (string, error) {
+	out, err := b.export(stackID)
+	if err != nil {
+		return "", err
+	}
+	if out == nil {
+		// Nothing is exported in a dry run.
+		return "", nil
+	}
+
+	template, err := io.ReadAll(out)
+	if err != nil {
+		return "", fmt.Errorf("Error: unable to read template: %v", err)
+	}
+	return hashBytes(template), nil
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
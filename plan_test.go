@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanApply(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/multiple-template", dir)
+	planFile := filepath.Join(t.TempDir(), "stack.plan")
+	flags := []string{"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org"}
+
+	makePlan := func() {
+		t.Helper()
+		if err := plan(append([]string{"stack-id", "-d", dir, "--out", planFile, "--allow-external-refs"}, flags...)); err != nil {
+			t.Fatalf("Unexpected error making plan: %v", err)
+		}
+	}
+
+	makePlan()
+	if len(f.applied) != 1 || !f.applied[0].DryRun {
+		t.Fatalf("Expected a single dry run request, got %+v", f.applied)
+	}
+
+	if err := apply(append([]string{planFile}, flags...)); err != nil {
+		t.Fatalf("Unexpected error applying plan: %v", err)
+	}
+	if pushed := f.pushed(); len(pushed) != 1 || pushed[0].StackID != "stack-id" {
+		t.Fatalf("Expected the plan to be applied, got %+v", f.applied)
+	}
+	if backups, err := listBackups(filepath.Join(dir, stateDir, backupsDir), "stack-id"); err != nil || len(backups) != 1 {
+		t.Errorf("Expected a backup to be taken before applying, got %v: %v", backups, err)
+	}
+
+	// A plan can't be applied once the directory has changed.
+	makePlan()
+	replaceInFile(t, filepath.Join(dir, "CheckThreshold/CPU Usage/query.flux"), `"usage_user"`, `"usage_system"`)
+	err := apply(append([]string{planFile}, flags...))
+	if err == nil || !strings.Contains(err.Error(), "has changed since the plan was made") {
+		t.Errorf("Expected an error after changing the directory, got: %v", err)
+	}
+
+	// Or the stack has changed.
+	makePlan()
+	remote := filepath.Join(t.TempDir(), "template.yml")
+	copyFile(t, f.template, remote)
+	replaceInFile(t, remote, "every: 1m0s", "every: 5m0s")
+	f.template = remote
+	err = apply(append([]string{planFile}, flags...))
+	if err == nil || !strings.Contains(err.Error(), "has changed in influxdb") {
+		t.Errorf("Expected an error after changing the stack, got: %v", err)
+	}
+
+	// Or the plan's template has been edited.
+	makePlan()
+	replaceInFile(t, planFile, "every: 1m0s", "every: 15m0s")
+	err = apply(append([]string{planFile}, flags...))
+	if err == nil || !strings.Contains(err.Error(), "doesn't match its hash") {
+		t.Errorf("Expected an error after editing the plan, got: %v", err)
+	}
+}
+
+func TestPlanApplyChanges(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/single-label/template.yml")
+	f.summary = `{"stackID": "stack-id", "diff": {"labels": [
+		{"kind": "Label", "stateStatus": "exists", "templateMetaName": "cool-ride-8cd001",
+			"new": {"name": "Version Controlled", "color": "#066fc5"},
+			"old": {"name": "Version Controlled", "color": "#ffffff"}}
+	]}}`
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/single-label", dir)
+	planFile := filepath.Join(t.TempDir(), "stack.plan")
+	flags := []string{"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org"}
+
+	if err := plan(append([]string{"stack-id", "-d", dir, "--out", planFile}, flags...)); err != nil {
+		t.Fatalf("Unexpected error making plan: %v", err)
+	}
+
+	// The changes to the existing label were reviewed in the plan, so are
+	// applied.
+	if err := apply(append([]string{planFile}, flags...)); err != nil {
+		t.Fatalf("Unexpected error applying plan: %v", err)
+	}
+	if pushed := f.pushed(); len(pushed) != 1 {
+		t.Errorf("Expected the plan to be applied, got %+v", f.applied)
+	}
+}
+
+func TestPlanCLI(t *testing.T) {
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/single-label", dir)
+
+	// The cli backend can't summarize the changes, which is checked before
+	// the influx cli is ever run.
+	err := plan([]string{"stack-id", "-d", dir, "--influx-cmd", "false", "--out", filepath.Join(dir, "stack.plan")})
+	if err == nil || !strings.Contains(err.Error(), "only supported by the http backend") {
+		t.Errorf("Expected an error planning with the cli backend, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stack.plan")); err == nil {
+		t.Errorf("Expected no plan to be written")
+	}
+}
@@ -4,27 +4,54 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
 )
 
 const pullUsage = `Pull a template from a stack in influx db and split it.
 
 Warning: This is a destructive operation, the destination directory will be
-cleared if it already exists.
+cleared if it already exists, unless --merge is set.
+
+With --merge, the changes made to the stack since the last pull are merged into
+the directory, keeping any local changes. Where the same lines have changed both
+locally and in influxdb, both versions are written between conflict markers.
 
 Usage:
-  influxdb-stack-manager pull <stack-id> [flags]
+  influxdb-stack-manager pull [<stack-id>] [flags]
+
+If no stack-id is given, the one saved in the template directory is used.
+The stack-id is saved in the template directory after it has been pulled.
+
+Resources which don't belong to a stack can be pulled instead, to start
+managing them, by ID with --resource, or with --label and --kind. Given both,
+only resources of the kinds with one of the labels are pulled.
+
+With --data-file or --set, the values from the data that are found in the
+pulled templates are replaced with the template expressions for them, such
+as {{ .Thresholds.CPU }}. Values that more than one key has are left as they
+are, and reported.
 
 Flags:
 `
 
 func pull(args []string) error {
 	var cfg config
+	var merge bool
+	var resources []string
+	var filter exportFilter
 	fs := cfg.flagSet()
-	if err := fs.Parse(args); err != nil {
+	fs.BoolVar(&merge, "merge", false, "Merge the changes into the directory, instead of replacing it.")
+	fs.StringSliceVar(&resources, "resource", nil, "Pull resources, given as <kind>=<id>, instead of a stack.")
+	fs.StringSliceVar(&filter.labels, "label", nil, "Pull the resources with the label, instead of a stack.")
+	fs.StringSliceVar(&filter.kinds, "kind", nil, "Pull the resources of the kind, instead of a stack.")
+	cfg.data.flags(fs)
+	if err := cfg.parse(fs, args); err != nil {
 		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager pull -h' for help", err)
 	}
 
@@ -33,28 +60,144 @@ func pull(args []string) error {
 		return nil
 	}
 
-	if fs.NArg() < 1 {
-		return errors.New("Error: required arg missing: stack-id\nSee 'influxdb-stack-manager pull -h' for help")
+	for _, r := range resources {
+		sr, err := parseResource(r)
+		if err != nil {
+			return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager pull -h' for help", err)
+		}
+		filter.resources = append(filter.resources, sr)
 	}
 
-	args = []string{"export", "stack", fs.Arg(0)}
-	args = append(args, cfg.generateArgs()...)
+	// Only a stack's ID is saved, filtered resources don't belong to one.
+	var stackID string
+	if filter.empty() {
+		id, err := cfg.stackID(fs.Args())
+		if err != nil {
+			return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager pull -h' for help", err)
+		}
+		stackID = id
+	} else if fs.NArg() > 0 {
+		return errors.New("Error: a stack-id can't be given with --resource, --label or --kind\nSee 'influxdb-stack-manager pull -h' for help")
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	ex, err := loadExtractors(cfg.extractors)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	data, overrides, err := cfg.data.load()
+	if err != nil {
+		return fmt.Errorf("Error: unable to load data: %v", err)
+	}
+	withOverrides, err := applyOverrides(copyData(data), overrides, nil)
+	if err != nil {
+		return fmt.Errorf("Error: unable to load data: %v", err)
+	}
+	values := dataValues(withOverrides)
+
+	var out io.Reader
+	if stackID != "" {
+		out, err = b.export(stackID)
+	} else {
+		out, err = b.exportFiltered(filter)
+	}
+	if err != nil {
+		return err
+	}
 	if cfg.dryRun {
-		log.Println("Dry run - calling:")
-		log.Println(cfg.influxCmd, strings.Join(args, " "))
 		return nil
 	}
 
-	cmd := exec.Command(cfg.influxCmd, args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return errors.New(out.String())
+	template, err := io.ReadAll(out)
+	if err != nil {
+		return fmt.Errorf("Error: unable to read template: %v", err)
+	}
+
+	// Expressions are only restored where they were before, which is found
+	// by rendering the templates as they are now.
+	var previous map[string]renderedFile
+	if !cfg.data.empty() {
+		previous = renderFiles(cfg.directory, data, overrides)
+	}
+
+	var conflicts, untemplated []string
+	if merge {
+		conflicts, untemplated, err = mergeTemplate(cfg.directory, template, ex, values, previous)
+		if err != nil {
+			return fmt.Errorf("Error: couldn't merge template: %v", err)
+		}
+	} else {
+		if err := splitTemplate(cfg.directory, bytes.NewReader(template), ex); err != nil {
+			return fmt.Errorf("Error: couldn't split template: %v\nPlease report this as an issue", err)
+		}
+		if untemplated, err = reverseTemplate(cfg.directory, values, previous); err != nil {
+			return fmt.Errorf("Error: couldn't restore templated values: %v", err)
+		}
+	}
+
+	// Keep a copy of what we pulled, to merge the next pull against. It is
+	// templated in the same way, so that only real changes are merged.
+	base := filepath.Join(cfg.directory, stateDir, baseDir)
+	if err := splitTemplate(base, bytes.NewReader(template), ex); err != nil {
+		return fmt.Errorf("Error: couldn't save pulled template: %v", err)
+	}
+	if _, err := reverseTemplate(base, values, previous); err != nil {
+		return fmt.Errorf("Error: couldn't save pulled template: %v", err)
+	}
+	if err := writeSnapshot(cfg.directory, base); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// Filtered resources don't belong to a stack, so any saved stack ID is
+	// removed, rather than a later push applying just them to that stack.
+	if stackID != "" {
+		err = writeStackID(cfg.directory, stackID)
+	} else {
+		err = removeStackID(cfg.directory)
+	}
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	if len(untemplated) > 0 {
+		log.Printf("Values from the data which weren't templated there before were left as they are:\n  %s", strings.Join(untemplated, "\n  "))
 	}
 
-	if err := splitTemplate(cfg.directory, &out); err != nil {
-		return fmt.Errorf("Error: couldn't split template: %v\nPlease report this as an issue", err)
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Error: merge conflicts found in:\n  %s\nResolve the conflicts before pushing", strings.Join(conflicts, "\n  "))
 	}
 	return nil
 }
+
+// mergeTemplate splits the template and merges it into the directory, using the
+// template saved by the last pull as the base. The expressions are restored
+// where they were previously before merging. It returns any conflicting files,
+// and any values found which weren't templated before.
+func mergeTemplate(dir string, template []byte, ex extract.Set, values map[string][]string, previous map[string]renderedFile) ([]string, []string, error) {
+	base := filepath.Join(dir, stateDir, baseDir)
+	if _, err := os.Stat(base); err != nil {
+		return nil, nil, fmt.Errorf("no previous pull found in %q to merge with, pull without --merge first", dir)
+	}
+
+	remote, err := os.MkdirTemp("", "pull")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(remote)
+
+	if err := splitTemplate(remote, bytes.NewReader(template), ex); err != nil {
+		return nil, nil, fmt.Errorf("couldn't split template: %v", err)
+	}
+	untemplated, err := reverseTemplate(remote, values, previous)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't restore templated values: %v", err)
+	}
+
+	conflicts, err := mergeDirs(base, dir, remote)
+	return conflicts, untemplated, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPullFiltered(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	dir := t.TempDir()
+	err := pull([]string{"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org", "-d", dir,
+		"--resource", "Dashboard=0a1b", "--label", "team-x", "--kind", "Dashboard,Task"})
+	if err != nil {
+		t.Fatalf("Unexpected error pulling resources: %v", err)
+	}
+	compareDirs(t, dir, "testdata/split/multiple-template")
+
+	var org exportOrg
+	org.OrgID = "0123456789abcdef"
+	org.ResourceFilters.ByLabel = []string{"team-x"}
+	org.ResourceFilters.ByResourceKind = []string{"Dashboard", "Task"}
+	exp := exportRequest{
+		OrgIDs:    []exportOrg{org},
+		Resources: []exportResource{{Kind: "Dashboard", ID: "0a1b"}},
+	}
+	if diff := cmp.Diff([]exportRequest{exp}, f.exports); diff != "" {
+		t.Errorf("Unexpected export request:\n%s", diff)
+	}
+
+	// The resources don't belong to a stack, so no ID is saved.
+	if _, err := os.Stat(filepath.Join(dir, stateDir, stackIDFile)); err == nil {
+		t.Errorf("Expected no stack ID to be saved")
+	}
+
+	err = pull([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir, "--kind", "Task"})
+	if err == nil || !strings.Contains(err.Error(), "can't be given with") {
+		t.Errorf("Expected an error pulling a stack and filtered resources, got: %v", err)
+	}
+}
+
+func TestPullFilteredForgetsStack(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+	flags := []string{"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org"}
+
+	dir := t.TempDir()
+	if err := pull(append([]string{"stack-id", "-d", dir}, flags...)); err != nil {
+		t.Fatalf("Unexpected error pulling stack: %v", err)
+	}
+	if id, err := readStackID(dir); err != nil || id != "stack-id" {
+		t.Fatalf("Expected the stack ID to be saved, got %q, %v", id, err)
+	}
+
+	// Pulling only some resources replaces the directory with them, so it
+	// no longer holds the whole stack, and pushing it mustn't apply just
+	// them to that stack.
+	if err := pull(append([]string{"-d", dir, "--kind", "Task"}, flags...)); err != nil {
+		t.Fatalf("Unexpected error pulling resources: %v", err)
+	}
+	if id, err := readStackID(dir); err != nil || id != "" {
+		t.Errorf("Expected the saved stack ID to be removed, got %q, %v", id, err)
+	}
+
+	err := push(append([]string{"-d", dir, "--no-backup", "--force", "true"}, flags...))
+	if err == nil || !strings.Contains(err.Error(), "no stack ID is saved") {
+		t.Errorf("Expected an error pushing without a stack ID, got: %v", err)
+	}
+	if pushed := f.pushed(); len(pushed) != 0 {
+		t.Errorf("Expected nothing to be pushed, got %+v", pushed)
+	}
+}
+
+func TestExportArgs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		filter exportFilter
+		exp    []string
+		err    string
+	}{
+		"resources": {
+			filter: exportFilter{resources: []stackResource{
+				{Kind: "Dashboard", ResourceID: "a"},
+				{Kind: "Bucket", ResourceID: "b"},
+				{Kind: "Dashboard", ResourceID: "c"},
+			}},
+			exp: []string{"export", "--dashboards", "a,c", "--buckets", "b"},
+		},
+		"labels and kinds": {
+			filter: exportFilter{labels: []string{"team-x"}, kinds: []string{"Dashboard"}},
+			exp:    []string{"export", "all", "--filter", "labelName=team-x", "--filter", "resourceKind=Dashboard"},
+		},
+		"unknown kind": {
+			filter: exportFilter{resources: []stackResource{{Kind: "Dashbored", ResourceID: "a"}}},
+			err:    `kind "Dashbored"`,
+		},
+		"mixed": {
+			filter: exportFilter{resources: []stackResource{{Kind: "Dashboard", ResourceID: "a"}}, labels: []string{"team-x"}},
+			err:    "use --backend http",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args, err := exportArgs(tc.filter)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.exp, args); diff != "" {
+				t.Errorf("Unexpected args:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPullKeepsScopedData(t *testing.T) {
+	_, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+	flags := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org"}
+
+	dir := t.TempDir()
+	if err := pull(append(flags, "-d", dir)); err != nil {
+		t.Fatalf("Unexpected error pulling stack: %v", err)
+	}
+
+	// Data files are written by hand, including for a resource which has
+	// since been removed from the stack.
+	files := map[string]string{
+		"Task/data.yml":                "Every: 5m\n",
+		"Task/CPU Downsample/data.yml": "Bucket: cpu\n",
+		"Dashboard/Removed/data.yml":   "Title: gone\n",
+	}
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatalf("Unable to create dir: %v", err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+
+	if err := pull(append(flags, "-d", dir)); err != nil {
+		t.Fatalf("Unexpected error pulling stack: %v", err)
+	}
+	for name, contents := range files {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != contents {
+			t.Errorf("Expected %q to survive the pull, got %q, %v", name, b, err)
+		}
+	}
+
+	// The data files aren't counted as changes, and the directory left
+	// with only data in it isn't a resource.
+	statuses, err := resourceStatuses(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error getting statuses: %v", err)
+	}
+	for _, s := range statuses {
+		if s.Status != statusUnchanged {
+			t.Errorf("Expected %s to be unchanged after pulling, got %s", s.Dir, s.Status)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := uniteTemplate(dir, &buf, dataOptions{}, formatYAML, extract.Builtin(), true); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"github.com/spf13/pflag"
 )
 
 const pushUsage = `Push local changes to a stack in influxdb
 
 Usage:
-  influxdb-stack-manager push <stack-id> [flags]
+  influxdb-stack-manager push [<stack-id>] [flags]
+
+If no stack-id is given, the one saved in the template directory is used.
+
+Before pushing, the stack is exported and saved in the backup directory, so
+that it can be restored with the rollback command.
+
+With --all-envs or --envs, the directory is pushed to several environments
+from the project manifest at once, each with its own stack and data file.
+As the changes can't be confirmed for each, --force must be set. A report of
+which environments were pushed to is printed at the end.
 
 Flags:
 `
@@ -20,12 +37,20 @@ Flags:
 func push(args []string) error {
 	var cfg config
 	var force string
-	var dataFile string
+	var allEnvs bool
+	var envs []string
+	var parallel int
 
 	fs := cfg.flagSet()
-	fs.StringVar(&force, "force", "", "Set to 'true' to skip confirmation before applying changes. Set to 'conflict' to skip confirmation and overwrite existing resources")
-	fs.StringVar(&dataFile, "data-file", "", "Data file to use for injected data in templates")
-	if err := fs.Parse(args); err != nil {
+	fs.StringVar(&force, "force", "", "Set to 'true' to skip confirmation, refusing changes to existing resources. Set to 'conflict' to skip confirmation and apply changes to existing resources too")
+	cfg.data.flags(fs)
+	fs.BoolVar(&cfg.external, "allow-external-refs", false, "Allow associations and notification endpoints which are not in the template, as they already exist in influxdb.")
+	fs.BoolVar(&allEnvs, "all-envs", false, "Push to every environment in the project manifest.")
+	fs.StringSliceVar(&envs, "envs", nil, "Comma separated environments in the project manifest to push to.")
+	fs.IntVar(&parallel, "parallel", 4, "Maximum number of environments to push to at once.")
+	fs.BoolVar(&cfg.noBackup, "no-backup", false, "Don't back up the stack before pushing to it.")
+	fs.StringVar(&cfg.backupDir, "backup-dir", "", "Directory to save backups in, if not the one in the template directory.")
+	if err := cfg.parse(fs, args); err != nil {
 		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager push -h' for help", err)
 	}
 
@@ -34,43 +59,181 @@ func push(args []string) error {
 		return nil
 	}
 
-	if fs.NArg() < 1 {
-		return errors.New("Error: required arg missing: stack-id\nSee 'influxdb-stack-manager push -h' for help")
+	if allEnvs || len(envs) > 0 {
+		return pushEnvs(cfg, fs, envs, force, parallel)
 	}
 
-	tmpFile, err := writeTemplateToFile(cfg.directory, dataFile)
-	if err != nil {
+	if err := pushTarget(cfg, fs.Args(), force); err != nil {
 		return err
 	}
+	if cfg.dryRun {
+		return nil
+	}
 
-	args = []string{"apply", "--stack-id", fs.Arg(0), "-f", tmpFile}
-	args = append(args, cfg.generateArgs()...)
-	if force != "" {
-		args = append(args, "--force", force)
+	// Record what was pushed, so status can show what has changed since.
+	if err := writeSnapshot(cfg.directory, cfg.directory); err != nil {
+		return fmt.Errorf("Error: %v", err)
 	}
+	return nil
+}
+
+// pushTarget unites the template directory and applies it to a single stack.
+func pushTarget(cfg config, args []string, force string) error {
+	stackID, err := cfg.stackID(args)
+	if err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager push -h' for help", err)
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	ex, err := loadExtractors(cfg.extractors)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	tmpFile, err := writeTemplateToFile(cfg.directory, cfg.data, ex, cfg.external)
+	if err != nil {
+		return err
+	}
+
 	if cfg.dryRun {
-		log.Println("Dry run - calling:")
-		log.Println(cfg.influxCmd, strings.Join(args, " "))
-		log.Printf("Tempfile %q will not be removed automatically\n", tmpFile)
-		return nil
+		fmt.Fprintf(cfg.stderr(), "Tempfile %q will not be removed automatically\n", tmpFile)
+	} else {
+		defer os.Remove(tmpFile)
+	}
+
+	secrets, err := cfg.secrets(tmpFile)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
 	}
-	defer os.Remove(tmpFile)
 
-	cmd := exec.Command(cfg.influxCmd, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	// Save what is in influxdb first, so that it can be rolled back to.
+	if _, err := backupStack(b, cfg, stackID); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	return b.apply(stackID, tmpFile, force, secrets)
+}
+
+// A pushResult is the outcome of pushing to one environment.
+type pushResult struct {
+	env    string
+	cfg    config
+	output bytes.Buffer
+	err    error
+}
+
+// pushEnvs pushes to several environments from the project manifest at once,
+// then reports how each of them went.
+func pushEnvs(cfg config, fs *pflag.FlagSet, envs []string, force string, parallel int) error {
+	switch {
+	case cfg.env != "":
+		return errors.New("Error: --env can't be used with --all-envs or --envs\nSee 'influxdb-stack-manager push -h' for help")
+	case fs.NArg() > 0:
+		return errors.New("Error: a stack-id can't be given with --all-envs or --envs, each environment has its own\nSee 'influxdb-stack-manager push -h' for help")
+	case force == "" && !cfg.dryRun:
+		return errors.New("Error: --force is required with --all-envs or --envs, as the changes can't be confirmed for each environment\nSee 'influxdb-stack-manager push -h' for help")
+	case parallel < 1:
+		return errors.New("Error: --parallel must be at least 1\nSee 'influxdb-stack-manager push -h' for help")
+	}
+
+	m, err := loadManifest(cfg.manifest)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if len(envs) == 0 {
+		envs = m.names()
+	}
+
+	results := make([]*pushResult, len(envs))
+	for i, name := range envs {
+		env, ok := m.Environments[name]
+		if !ok {
+			return fmt.Errorf("Error: environment %q not found in %q", name, cfg.manifest)
+		}
+
+		r := &pushResult{env: name, cfg: cfg}
+		r.cfg.env = name
+		r.cfg.applyEnv(fs, env, filepath.Dir(cfg.manifest))
+		r.cfg.out = &r.output
+		results[i] = r
+	}
+
+	// Push using a bounded pool of workers, buffering the output
+	// of each push so that they don't get mixed up.
+	jobs := make(chan *pushResult)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel && i < len(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				r.err = pushTarget(r.cfg, nil, force)
+			}
+		}()
+	}
+	for _, r := range results {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+
+	var failed int
+	pushed := map[string]bool{}
+	for _, r := range results {
+		if r.output.Len() > 0 {
+			fmt.Printf("==> %s\n%s\n", r.env, r.output.String())
+		}
+
+		// Only record a snapshot for directories pushed to every environment.
+		ok, seen := pushed[r.cfg.directory]
+		pushed[r.cfg.directory] = r.err == nil && (ok || !seen)
+		if r.err != nil {
+			failed++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENVIRONMENT\tRESULT")
+	for _, r := range results {
+		result := "ok"
+		if r.err != nil {
+			result = "failed: " + strings.TrimPrefix(r.err.Error(), "Error: ")
+		}
+		fmt.Fprintf(w, "%s\t%s\n", r.env, strings.ReplaceAll(result, "\n", " "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if !cfg.dryRun {
+		for dir, ok := range pushed {
+			if !ok {
+				continue
+			}
+			if err := writeSnapshot(dir, dir); err != nil {
+				return fmt.Errorf("Error: %v", err)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Error: %d of %d environments failed to push", failed, len(results))
+	}
+	return nil
 }
 
-func writeTemplateToFile(dir, dataDir string) (string, error) {
+func writeTemplateToFile(dir string, data dataOptions, ex extract.Set, external bool) (string, error) {
 	f, err := os.CreateTemp("", "*.yml")
 	if err != nil {
 		return "", fmt.Errorf("Error: unable to create temp file: %v", err)
 	}
 	defer f.Close()
 
-	if err := uniteTemplate(dir, f, dataDir); err != nil {
+	if err := uniteTemplate(dir, f, data, formatYAML, ex, external); err != nil {
 		return "", fmt.Errorf("Error: unable to unite templates: %v", err)
 	}
 
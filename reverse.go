@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dataValues returns the template expression for each value in the data,
+// keyed by the value as it is rendered. A value shared by several keys has
+// more than one expression. Lists, booleans and empty strings are left out,
+// as they can't be told apart from the values which weren't templated.
+func dataValues(data interface{}) map[string][]string {
+	values := map[string][]string{}
+	var walk func(v interface{}, path []string)
+	walk = func(v interface{}, path []string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				walk(item, append(path[:len(path):len(path)], k))
+			}
+
+		case []interface{}, bool, nil:
+
+		default:
+			s := fmt.Sprint(v)
+			if s != "" && len(path) > 0 {
+				values[s] = append(values[s], dataExpr(path))
+			}
+		}
+	}
+	walk(data, nil)
+
+	for _, exprs := range values {
+		sort.Strings(exprs)
+	}
+	return values
+}
+
+// dataExpr returns the template expression for the value at the path.
+func dataExpr(path []string) string {
+	for _, key := range path {
+		if !isIdentifier(key) {
+			quoted := make([]string, len(path))
+			for i, key := range path {
+				quoted[i] = fmt.Sprintf("%q", key)
+			}
+			return fmt.Sprintf("{{ index . %s }}", strings.Join(quoted, " "))
+		}
+	}
+	return "{{ ." + strings.Join(path, ".") + " }}"
+}
+
+// isIdentifier returns whether the key can be used as a field in a template.
+func isIdentifier(key string) bool {
+	for i, r := range key {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// A renderedFile is the source of a file in a template directory, along with
+// what it renders to.
+type renderedFile struct {
+	source   string
+	rendered string
+}
+
+// renderFiles renders each of the files in a template directory with the data,
+// keyed by their path relative to it. Files which can't be rendered are left
+// out, as are whole resources if their templates can't be parsed.
+func renderFiles(dir string, data interface{}, overrides []dataOverride) map[string]renderedFile {
+	files := map[string]renderedFile{}
+	kinds, err := listKindDirs(dir)
+	if err != nil {
+		return files
+	}
+
+	for _, k := range kinds {
+		kindData, err := scopeData(data, filepath.Join(dir, k))
+		if err != nil {
+			continue
+		}
+		items, err := os.ReadDir(filepath.Join(dir, k))
+		if err != nil {
+			continue
+		}
+
+		for _, item := range items {
+			resDir := filepath.Join(dir, k, item.Name())
+			if !item.IsDir() {
+				continue
+			}
+			data, err := scopeData(kindData, resDir)
+			if err != nil {
+				continue
+			}
+			if data, err = applyOverrides(copyData(data), overrides, nil); err != nil {
+				continue
+			}
+			tmpl, err := parseTemplateDir(resDir)
+			if err != nil {
+				continue
+			}
+			tmpl = tmpl.Option("missingkey=error")
+
+			for _, t := range tmpl.Templates() {
+				b, err := os.ReadFile(filepath.Join(resDir, t.Name()))
+				if err != nil {
+					continue
+				}
+				var buf strings.Builder
+				if err := tmpl.ExecuteTemplate(&buf, t.Name(), data); err != nil {
+					continue
+				}
+				files[filepath.Join(k, item.Name(), t.Name())] = renderedFile{source: string(b), rendered: buf.String()}
+			}
+		}
+	}
+	return files
+}
+
+// reverseTemplate restores the template expressions in a split template
+// directory, where they were before. A file which renders the same from the
+// previous templates is replaced by its previous source. Otherwise, only the
+// lines of extracted files, and the values in template.yml, which are the same
+// as ones that were templated are restored. Values from the data found
+// anywhere else are left as they are, as they weren't templated before, and
+// reported.
+func reverseTemplate(dir string, values map[string][]string, previous map[string]renderedFile) ([]string, error) {
+	if len(values) == 0 && len(previous) == 0 {
+		return nil, nil
+	}
+
+	kinds, err := listKindDirs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dir %q: %v", dir, err)
+	}
+
+	var untemplated []string
+	for _, k := range kinds {
+		items, err := os.ReadDir(filepath.Join(dir, k))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read dir %q: %v", filepath.Join(dir, k), err)
+		}
+
+		for _, item := range items {
+			if !item.IsDir() {
+				continue
+			}
+
+			files, err := os.ReadDir(filepath.Join(dir, k, item.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if f.IsDir() || f.Name() == scopedDataFile {
+					continue
+				}
+
+				rel := filepath.Join(k, item.Name(), f.Name())
+				filename := filepath.Join(dir, rel)
+				b, err := os.ReadFile(filename)
+				if err != nil {
+					return nil, fmt.Errorf("unable to read %q: %v", filename, err)
+				}
+
+				var out []byte
+				var found []string
+				prev, ok := previous[rel]
+				if ok && prev.rendered == string(b) {
+					out = []byte(prev.source)
+				} else if f.Name() == templateFile {
+					out, found, err = reverseYAML(b, prev, values)
+					if err != nil {
+						return nil, fmt.Errorf("unable to decode %q: %v", filename, err)
+					}
+				} else {
+					var s string
+					s, found = reverseText(string(b), prev, values)
+					out = []byte(s)
+				}
+
+				for _, v := range found {
+					untemplated = append(untemplated, fmt.Sprintf("%s: %q could be %s", rel, v, strings.Join(values[v], " or ")))
+				}
+				if !bytes.Equal(b, out) {
+					if err := os.WriteFile(filename, out, 0644); err != nil {
+						return nil, fmt.Errorf("unable to write %q: %v", filename, err)
+					}
+				}
+			}
+		}
+	}
+	return untemplated, nil
+}
+
+// reverseYAML restores the template expressions in the scalar values of a
+// template which are the same as the previous template rendered to, in the
+// same place, where that was templated. Quoted values stay quoted, so that
+// they are still strings once rendered. Any other value that matches a value
+// from the data, in a place which is new or has changed, is returned.
+func reverseYAML(b []byte, previous renderedFile, values map[string][]string) ([]byte, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	// The expressions aren't valid yaml, so the previous source has them
+	// swapped for placeholders to find where they were. If either the
+	// source or what it rendered to can't be decoded, nothing is restored.
+	source, actions := placeholderActions(previous.source)
+	var sources, rendered map[string]*yaml.Node
+	var srcDoc, renderedDoc yaml.Node
+	if yaml.Unmarshal([]byte(source), &srcDoc) == nil && yaml.Unmarshal([]byte(previous.rendered), &renderedDoc) == nil {
+		sources, rendered = scalarPaths(&srcDoc), scalarPaths(&renderedDoc)
+	}
+
+	var restored bool
+	var found []string
+	for path, n := range scalarPaths(&doc) {
+		src, old := sources[path], rendered[path]
+		if src != nil && old != nil && old.Value == n.Value {
+			if strings.Contains(src.Value, placeholderPrefix) {
+				n.Value = src.Value
+				n.Tag = ""
+				n.Style = src.Style
+				restored = true
+			}
+			continue
+		}
+		if _, ok := values[n.Value]; ok {
+			found = appendUnique(found, n.Value)
+		}
+	}
+	sort.Strings(found)
+
+	if !restored {
+		return b, found, nil
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	pairs := make([]string, 0, 2*len(actions))
+	for i, action := range actions {
+		pairs = append(pairs, placeholder(i), action)
+	}
+	return []byte(strings.NewReplacer(pairs...).Replace(buf.String())), found, nil
+}
+
+// Prefix of the placeholders that template actions are swapped for.
+const placeholderPrefix = "__stack_manager_expr_"
+
+// placeholder returns the placeholder for the i'th template action.
+func placeholder(i int) string {
+	return fmt.Sprintf("%s%d__", placeholderPrefix, i)
+}
+
+// placeholderActions replaces each template action in the source with a
+// placeholder, returning the actions in the order they were found.
+func placeholderActions(source string) (string, []string) {
+	var out strings.Builder
+	var actions []string
+	for {
+		start := strings.Index(source, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(source[start:], "}}")
+		if end < 0 {
+			break
+		}
+		end += start + len("}}")
+
+		out.WriteString(source[:start])
+		out.WriteString(placeholder(len(actions)))
+		actions = append(actions, source[start:end])
+		source = source[end:]
+	}
+	out.WriteString(source)
+	return out.String(), actions
+}
+
+// scalarPaths returns each of the scalar nodes in a document, keyed by the map
+// keys and list indices of the path to it.
+func scalarPaths(doc *yaml.Node) map[string]*yaml.Node {
+	paths := map[string]*yaml.Node{}
+	var walk func(n *yaml.Node, path string)
+	walk = func(n *yaml.Node, path string) {
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				walk(c, fmt.Sprintf("%s[%d]", path, i))
+			}
+
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				walk(n.Content[i+1], fmt.Sprintf("%s[%q]", path, n.Content[i].Value))
+			}
+
+		case yaml.ScalarNode:
+			paths[path] = n
+		}
+	}
+	walk(doc, "")
+	return paths
+}
+
+// reverseText restores the lines of the text which are the same as a line
+// that the previous file rendered from a templated one. Values from the data
+// found as whole words in any other line, which is new or has changed, are
+// returned.
+func reverseText(text string, previous renderedFile, values map[string][]string) (string, []string) {
+	templated, literal := templatedLines(previous)
+
+	lines := strings.SplitAfter(text, "\n")
+	var found []string
+	for i, line := range lines {
+		content := strings.TrimSuffix(line, "\n")
+		if src := templated[content]; src != "" {
+			lines[i] = src + line[len(content):]
+			continue
+		}
+		if !literal[content] {
+			for _, v := range findValues(content, values) {
+				found = appendUnique(found, v)
+			}
+		}
+	}
+	return strings.Join(lines, ""), found
+}
+
+// templatedLines returns the source of each templated line of the previous
+// file, keyed by the line it rendered to, along with the lines which weren't
+// templated. A rendered line which could have come from more than one source
+// line maps to "". If the lines can't be paired up, because an expression
+// rendered to more or fewer lines, neither is returned.
+func templatedLines(previous renderedFile) (map[string]string, map[string]bool) {
+	src := strings.Split(previous.source, "\n")
+	out := strings.Split(previous.rendered, "\n")
+	if len(src) != len(out) {
+		return nil, nil
+	}
+
+	templated := map[string]string{}
+	literal := map[string]bool{}
+	for i := range src {
+		if !strings.Contains(src[i], "{{") {
+			if src[i] != out[i] {
+				return nil, nil
+			}
+			literal[out[i]] = true
+			continue
+		}
+		if s, ok := templated[out[i]]; ok && s != src[i] {
+			templated[out[i]] = ""
+			continue
+		}
+		templated[out[i]] = src[i]
+	}
+
+	for line := range templated {
+		if literal[line] {
+			templated[line] = ""
+		}
+	}
+	return templated, literal
+}
+
+// findValues returns the values from the data which are found as whole words
+// in the text. Longer values are matched first, so that a value isn't found
+// within another.
+func findValues(text string, values map[string][]string) []string {
+	sorted := make([]string, 0, len(values))
+	for v := range values {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	type match struct{ start, end int }
+	var matches []match
+	var found []string
+	overlaps := func(start, end int) bool {
+		for _, m := range matches {
+			if start < m.end && m.start < end {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, v := range sorted {
+		for offset := 0; ; {
+			i := strings.Index(text[offset:], v)
+			if i < 0 {
+				break
+			}
+			start, end := offset+i, offset+i+len(v)
+			offset = start + 1
+
+			if !isWordBoundary(text, start, end) || overlaps(start, end) {
+				continue
+			}
+			matches = append(matches, match{start: start, end: end})
+			found = appendUnique(found, v)
+		}
+	}
+	return found
+}
+
+// isWordBoundary returns whether text[start:end] is a whole word, rather than
+// part of a longer name or number, such as cpu-total or 0.75.
+func isWordBoundary(text string, start, end int) bool {
+	isWord := func(r rune) bool {
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	isJoiner := func(r rune) bool {
+		return r == '.' || r == '-'
+	}
+
+	if start > 0 {
+		r, n := utf8.DecodeLastRuneInString(text[:start])
+		if isWord(r) {
+			return false
+		}
+		if isJoiner(r) {
+			if r, _ := utf8.DecodeLastRuneInString(text[:start-n]); isWord(r) {
+				return false
+			}
+		}
+	}
+
+	if end < len(text) {
+		r, n := utf8.DecodeRuneInString(text[end:])
+		if isWord(r) {
+			return false
+		}
+		if isJoiner(r) {
+			if r, _ := utf8.DecodeRuneInString(text[end+n:]); isWord(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// appendUnique appends the value to the list, if it isn't already in it.
+func appendUnique(list []string, v string) []string {
+	for _, item := range list {
+		if item == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
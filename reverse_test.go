@@ -0,0 +1,283 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReverseText(t *testing.T) {
+	values := dataValues(map[string]interface{}{
+		"Measurement": "cpu",
+		"Region":      "eu-west",
+		"Every":       "1h",
+		"Threshold":   75,
+		"Enabled":     true,
+		"Stats":       map[string]interface{}{"CPU": "mean", "Mem": "mean"},
+		"tag-keys":    map[string]interface{}{"host": "host-a"},
+	})
+
+	previous := renderedFile{
+		source: `from(bucket: "cpu")
+  |> range(start: -{{ .Every }})
+  |> filter(fn: (r) => r.region == "{{ .Region }}")
+  |> filter(fn: (r) => r.host == "{{ index . "tag-keys" "host" }}")
+`,
+		rendered: `from(bucket: "cpu")
+  |> range(start: -1h)
+  |> filter(fn: (r) => r.region == "eu-west")
+  |> filter(fn: (r) => r.host == "host-a")
+`,
+	}
+
+	for name, tc := range map[string]struct {
+		text     string
+		previous renderedFile
+		exp      string
+		found    []string
+	}{
+		"templated lines": {
+			text: `from(bucket: "cpu")
+  |> range(start: -1h)
+  |> filter(fn: (r) => r.host == "host-a")
+  |> yield()
+`,
+			previous: previous,
+			exp: `from(bucket: "cpu")
+  |> range(start: -{{ .Every }})
+  |> filter(fn: (r) => r.host == "{{ index . "tag-keys" "host" }}")
+  |> yield()
+`,
+		},
+		"changed lines": {
+			text: `from(bucket: "cpu")
+  |> range(start: -1h)
+  |> filter(fn: (r) => r.region == "eu-west" or r.region == "us-east")
+`,
+			previous: previous,
+			exp: `from(bucket: "cpu")
+  |> range(start: -{{ .Every }})
+  |> filter(fn: (r) => r.region == "eu-west" or r.region == "us-east")
+`,
+			found: []string{"eu-west"},
+		},
+		"new lines": {
+			text:     "  |> range(start: -1h)\n  |> aggregateWindow(every: 1h, fn: mean)\n",
+			previous: previous,
+			exp:      "  |> range(start: -{{ .Every }})\n  |> aggregateWindow(every: 1h, fn: mean)\n",
+			found:    []string{"mean", "1h"},
+		},
+		"whole words": {
+			text:  `r._value > 75 and r._value < 0.75 or r._value == 175 or r["cpu"] == "cpu-total" or r.cpu_usage > 1`,
+			exp:   `r._value > 75 and r._value < 0.75 or r._value == 175 or r["cpu"] == "cpu-total" or r.cpu_usage > 1`,
+			found: []string{"cpu", "75"},
+		},
+		"not templated before": {
+			text:  `range(start: -1h)`,
+			exp:   `range(start: -1h)`,
+			found: []string{"1h"},
+		},
+		"bools": {
+			text: `createEmpty: true`,
+			exp:  `createEmpty: true`,
+		},
+		"multi-line expressions": {
+			text: "tags:\n  - a\n  - b\nevery: 1h\n",
+			previous: renderedFile{
+				source:   "tags:\n{{ .Tags | toYaml | indent 2 }}\nevery: {{ .Every }}\n",
+				rendered: "tags:\n  - a\n  - b\nevery: 1h\n",
+			},
+			exp:   "tags:\n  - a\n  - b\nevery: 1h\n",
+			found: []string{"1h"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			act, found := reverseText(tc.text, tc.previous, values)
+			if diff := cmp.Diff(tc.exp, act); diff != "" {
+				t.Errorf("Unexpected text (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.found, found); diff != "" {
+				t.Errorf("Unexpected values found (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReverseYAML(t *testing.T) {
+	values := dataValues(map[string]interface{}{
+		"Every":   "1h",
+		"Version": "1.10",
+		"Level":   "CRIT",
+		"Fn":      "mean",
+	})
+
+	previous := renderedFile{
+		source: `apiVersion: influxdata.com/v2alpha1
+kind: Task
+metadata:
+  name: cpu
+spec:
+  every: {{ .Every }}
+  fn: mean
+  description: every {{ .Every }}
+  version: "{{ .Version }}"
+  thresholds:
+    - level: {{ .Level }}
+    - level: WARN
+`,
+		rendered: `apiVersion: influxdata.com/v2alpha1
+kind: Task
+metadata:
+  name: cpu
+spec:
+  every: 1h
+  fn: mean
+  description: every 1h
+  version: "1.10"
+  thresholds:
+    - level: CRIT
+    - level: WARN
+`,
+	}
+
+	// The export is formatted differently, and has a new offset, and the
+	// second threshold changed, since the previous pull.
+	src := `apiVersion: influxdata.com/v2alpha1
+kind: Task
+metadata:
+    name: cpu
+spec:
+    every: 1h
+    fn: mean
+    description: every 1h
+    version: "1.10"
+    offset: 1h
+    thresholds:
+        - level: CRIT
+        - level: CRIT
+`
+	exp := `apiVersion: influxdata.com/v2alpha1
+kind: Task
+metadata:
+  name: cpu
+spec:
+  every: {{ .Every }}
+  fn: mean
+  description: every {{ .Every }}
+  version: "{{ .Version }}"
+  offset: 1h
+  thresholds:
+    - level: {{ .Level }}
+    - level: CRIT
+`
+	act, found, err := reverseYAML([]byte(src), previous, values)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(exp, string(act)); diff != "" {
+		t.Errorf("Unexpected template (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"1h", "CRIT"}, found); diff != "" {
+		t.Errorf("Unexpected values found (-want +got):\n%s", diff)
+	}
+
+	// Without a previous template, nothing is restored.
+	act, found, err = reverseYAML([]byte(src), renderedFile{}, values)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(act) != src {
+		t.Errorf("Expected the template to be left as it is, got:\n%s", act)
+	}
+	if diff := cmp.Diff([]string{"1.10", "1h", "CRIT", "mean"}, found); diff != "" {
+		t.Errorf("Unexpected values found (-want +got):\n%s", diff)
+	}
+}
+
+func TestPullDataFile(t *testing.T) {
+	src := "testdata/templated/multiple-template"
+	dataFile := filepath.Join(src, "data.yml")
+
+	// Render the templates, as they would be exported from influxdb, with
+	// a change made to one of the queries in influxdb since.
+	rendered := filepath.Join(t.TempDir(), "template.yml")
+	if err := unite([]string{src, rendered, "--data-file", dataFile, "--allow-external-refs"}); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+	b, err := os.ReadFile(rendered)
+	if err != nil {
+		t.Fatalf("Unable to read template: %v", err)
+	}
+	changed := strings.Replace(string(b), "every: 5m, fn: mean", "every: 10m, fn: mean", 1)
+	if err := os.WriteFile(rendered, []byte(changed), 0600); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+
+	_, srv := newFakeInflux(t, "stack-id", rendered)
+	dir := t.TempDir()
+	copyDir(t, src, dir)
+
+	err = pull([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org", "-d", dir, "--data-file", dataFile})
+	if err != nil {
+		t.Fatalf("Unexpected error pulling stack: %v", err)
+	}
+
+	// Unchanged files are kept exactly as they were templated, even where
+	// values weren't templated, like the "cpu" tag here.
+	for _, name := range []string{"Dashboard/Test Dashboard/CPU_Single_Stat.flux", "Dashboard/Test Dashboard/CPU Usage_Xy.flux"} {
+		exp, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", name, err)
+		}
+		act, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", name, err)
+		}
+		if diff := cmp.Diff(string(exp), string(act)); diff != "" {
+			t.Errorf("Unexpected contents of %q (-want +got):\n%s", name, diff)
+		}
+	}
+
+	// The templates are formatted differently to those split from influxdb,
+	// so have their expressions restored where they were.
+	task, err := os.ReadFile(filepath.Join(dir, "Task/CPU Downsample/template.yml"))
+	if err != nil {
+		t.Fatalf("Unable to read template: %v", err)
+	}
+	if !strings.Contains(string(task), "every: {{ .DownsampleRates.CPU_Downsample }}\n") {
+		t.Errorf("Expected the task's every to be templated, got:\n%s", task)
+	}
+
+	// The changed query only has its templated line restored. The "cpu"
+	// values weren't templated before, so are left as they are.
+	exp := `from(bucket: "cpu")
+  |> range(start: -{{ .DownsampleRates.CPU_Downsample }})
+  |> filter(fn: (r) => r._measurement == "cpu")
+  |> aggregateWindow(every: 10m, fn: mean)
+  |> to(bucket: "cpu_downsample")`
+	act, err := os.ReadFile(filepath.Join(dir, "Task/CPU Downsample/query.flux"))
+	if err != nil {
+		t.Fatalf("Unable to read query: %v", err)
+	}
+	if diff := cmp.Diff(exp, strings.TrimSuffix(string(act), "\n")); diff != "" {
+		t.Errorf("Unexpected query (-want +got):\n%s", diff)
+	}
+
+	// The copy of the pull is templated in the same way.
+	for _, name := range []string{"Dashboard/Test Dashboard/CPU_Single_Stat.flux", "Task/CPU Downsample/query.flux", "Task/CPU Downsample/template.yml"} {
+		exp, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", name, err)
+		}
+		act, err := os.ReadFile(filepath.Join(dir, stateDir, baseDir, name))
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", name, err)
+		}
+		if diff := cmp.Diff(string(exp), string(act)); diff != "" {
+			t.Errorf("Unexpected contents of pulled copy of %q (-want +got):\n%s", name, diff)
+		}
+	}
+}
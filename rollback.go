@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const rollbackUsage = `Roll a stack back to a backup taken before it was pushed to.
+
+Before each push, the stack is exported and saved in the backup directory,
+named by the time it was taken. Rolling back applies one of these backups, the
+latest unless --to is set, in the same way as push, so the changes are shown
+and must be confirmed unless --force is set. A backup of the stack is taken
+first, so the rollback can itself be undone, and removed again if it isn't
+applied.
+
+Usage:
+  influxdb-stack-manager rollback [<stack-id>] [flags]
+
+If no stack-id is given, the one saved in the template directory is used.
+
+Flags:
+`
+
+// Layout of the timestamps that backups are named with. It sorts in time order.
+const backupTimeFormat = "20060102T150405.000Z"
+
+func rollback(args []string) error {
+	var cfg config
+	var force, to string
+	var list bool
+
+	fs := cfg.flagSet()
+	fs.StringVar(&force, "force", "", "Set to 'true' to skip confirmation, refusing changes to existing resources. Set to 'conflict' to skip confirmation and apply changes to existing resources too")
+	fs.StringVar(&to, "to", "", "Timestamp of the backup to roll back to, the latest if not set.")
+	fs.BoolVar(&list, "list", false, "List the backups of the stack, instead of rolling back.")
+	fs.StringVar(&cfg.backupDir, "backup-dir", "", "Directory holding backups, if not the one in the template directory.")
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager rollback -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(rollbackUsage + fs.FlagUsages())
+		return nil
+	}
+
+	stackID, err := cfg.stackID(fs.Args())
+	if err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager rollback -h' for help", err)
+	}
+
+	backups, err := listBackups(cfg.backupRoot(), stackID)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if list {
+		for _, ts := range backups {
+			fmt.Println(ts)
+		}
+		return nil
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("Error: no backups of stack %s found in %q", stackID, cfg.backupRoot())
+	}
+
+	if to == "" {
+		to = backups[len(backups)-1]
+	}
+	// Only a timestamp is accepted, so that --to can't name a file outside
+	// of the stack's backups.
+	if _, err := time.Parse(backupTimeFormat, to); err != nil {
+		return fmt.Errorf("Error: invalid --to %q, expected a timestamp such as %s, list them with --list", to, backupTimeFormat)
+	}
+	filename := filepath.Join(cfg.backupRoot(), stackID, to+".yml")
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("Error: no backup of stack %s taken at %q, list them with --list", stackID, to)
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	secrets, err := cfg.secrets(filename)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// The current state is backed up first, so the rollback can itself be
+	// undone, and then the backup is applied in the same way as a push,
+	// showing the changes before they are confirmed. If it isn't applied,
+	// the backup that was just taken isn't needed.
+	backup, err := backupStack(b, cfg, stackID)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if err := b.apply(stackID, filename, force, secrets); err != nil {
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return err
+	}
+	return nil
+}
+
+// backupRoot returns the directory that backups are saved in.
+func (cfg config) backupRoot() string {
+	if cfg.backupDir != "" {
+		return cfg.backupDir
+	}
+	return filepath.Join(cfg.directory, stateDir, backupsDir)
+}
+
+// backupStack exports the stack, and saves it in the backup directory named
+// by the current time. It returns the name of the backup file, which is empty
+// if backups are turned off.
+func backupStack(b backend, cfg config, stackID string) (string, error) {
+	if cfg.noBackup || cfg.dryRun {
+		return "", nil
+	}
+
+	out, err := b.export(stackID)
+	if err != nil {
+		return "", fmt.Errorf("unable to export stack to back it up: %v", err)
+	}
+
+	dir := filepath.Join(cfg.backupRoot(), stackID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create backup directory: %v", err)
+	}
+
+	filename := filepath.Join(dir, time.Now().UTC().Format(backupTimeFormat)+".yml")
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to create backup: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, out); err != nil {
+		return "", fmt.Errorf("unable to write backup %q: %v", filename, err)
+	}
+	return filename, f.Close()
+}
+
+// listBackups returns the timestamps of the backups of a stack, oldest first.
+func listBackups(root, stackID string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, stackID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read backups: %v", err)
+	}
+
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".yml") {
+			backups = append(backups, strings.TrimSuffix(e.Name(), ".yml"))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
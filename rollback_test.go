@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/single-label", dir)
+	flags := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token",
+		"--org", "my-org", "--force", "true", "-d", dir}
+
+	if err := rollback(flags); err == nil || !strings.Contains(err.Error(), "no backups") {
+		t.Errorf("Expected an error without any backups, got: %v", err)
+	}
+
+	if err := push(append(flags, "--no-backup")); err != nil {
+		t.Fatalf("Unexpected error pushing template: %v", err)
+	}
+	if backups, err := listBackups(filepath.Join(dir, stateDir, backupsDir), "stack-id"); err != nil || len(backups) != 0 {
+		t.Fatalf("Expected no backups with --no-backup, got %v: %v", backups, err)
+	}
+
+	if err := push(flags); err != nil {
+		t.Fatalf("Unexpected error pushing template: %v", err)
+	}
+	backups, err := listBackups(filepath.Join(dir, stateDir, backupsDir), "stack-id")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expected a backup to be taken, got %v: %v", backups, err)
+	}
+	if pushed := f.pushed(); len(pushed) != 2 || len(pushed[1].Template.Contents) != 1 {
+		t.Fatalf("Expected the label to be pushed, got %+v", pushed)
+	}
+
+	if err := rollback(append(flags, "--to", "20000101T000000.000Z")); err == nil {
+		t.Errorf("Expected an error rolling back to a missing backup")
+	}
+	for _, to := range []string{"../../template", "/etc/passwd", backups[0] + ".yml"} {
+		if err := rollback(append(flags, "--to", to)); err == nil || !strings.Contains(err.Error(), "invalid --to") {
+			t.Errorf("Expected --to %q to be rejected, got: %v", to, err)
+		}
+	}
+
+	// Without --force, the changes must be confirmed, and nothing is
+	// applied or left backed up if they aren't.
+	unforced := []string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org", "-d", dir}
+	if err := rollback(unforced); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("Expected the rollback to be aborted, got: %v", err)
+	}
+	if aborted, err := listBackups(filepath.Join(dir, stateDir, backupsDir), "stack-id"); err != nil || len(aborted) != 1 {
+		t.Errorf("Expected no backup to be taken for an aborted rollback, got %v: %v", aborted, err)
+	}
+	if pushed := f.pushed(); len(pushed) != 2 {
+		t.Errorf("Expected nothing to be applied for an aborted rollback, got %+v", pushed)
+	}
+
+	// Rolling back applies the stack as it was before the push.
+	if err := rollback(append(flags, "--to", backups[0])); err != nil {
+		t.Fatalf("Unexpected error rolling back: %v", err)
+	}
+	if pushed := f.pushed(); len(pushed) != 3 || len(pushed[2].Template.Contents) != 4 {
+		t.Errorf("Expected the backup to be applied, got %+v", pushed[len(pushed)-1])
+	}
+
+	// Which is itself backed up first.
+	backups, err = listBackups(filepath.Join(dir, stateDir, backupsDir), "stack-id")
+	if err != nil || len(backups) != 2 {
+		t.Errorf("Expected the rollback to take a backup, got %v: %v", backups, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables that secret values are read from.
+const secretEnvPrefix = "INFLUX_SECRET_"
+
+// Placeholder shown instead of secret values in dry runs.
+const redacted = "<redacted>"
+
+// secretFields lists the fields of each kind that influxdb stores as secrets.
+var secretFields = map[string][]string{
+	kindEndpointHTTP:      {"username", "password", "token"},
+	kindEndpointPagerDuty: {"routingKey"},
+	kindEndpointSlack:     {"token"},
+}
+
+// secretRef returns a reference to a secret stored in influxdb, for the
+// secret template function. The value is never written to the template,
+// but passed alongside it when it is applied.
+func secretRef(key string) string {
+	return fmt.Sprintf("{secretRef: {key: %q}}", key)
+}
+
+// redactSecrets replaces any secret values in the object with references to
+// them, returning the keys of the secrets which will need to be provided.
+func redactSecrets(obj *object) []string {
+	var keys []string
+	for _, field := range secretFields[obj.Kind] {
+		n := walkNode(&obj.Spec, field)
+		if n.Kind != yaml.ScalarNode || n.Value == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("%s-%s", obj.name(), field)
+		*n = yaml.Node{
+			Kind:  yaml.MappingNode,
+			Style: yaml.FlowStyle,
+			Content: []*yaml.Node{
+				{Kind: yaml.ScalarNode, Value: "secretRef"},
+				{Kind: yaml.MappingNode, Style: yaml.FlowStyle, Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Value: "key"},
+					{Kind: yaml.ScalarNode, Value: key},
+				}},
+			},
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// templateSecrets returns the keys of all the secrets referenced
+// in the template file, in alphabetical order.
+func templateSecrets(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open template: %v", err)
+	}
+	defer f.Close()
+
+	objs, err := decodeObjects(f)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	for _, obj := range objs {
+		findSecretRefs(&obj.Spec, seen)
+	}
+
+	var keys []string
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// findSecretRefs adds the key of every secretRef under the node to the set.
+func findSecretRefs(node *yaml.Node, keys map[string]struct{}) {
+	if node.Kind == yaml.MappingNode {
+		if key := walkNode(walkNode(node, "secretRef"), "key"); key.Value != "" {
+			keys[key.Value] = struct{}{}
+		}
+	}
+	for _, n := range node.Content {
+		findSecretRefs(n, keys)
+	}
+}
+
+// secrets returns the values of the secrets referenced in the template file,
+// from the secrets file or the environment. Secrets without a value are left
+// out, so that the value already stored in influxdb is used.
+func (cfg config) secrets(filename string) (map[string]string, error) {
+	keys, err := templateSecrets(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	stored := map[string]string{}
+	if cfg.secretsFile != "" {
+		b, err := os.ReadFile(cfg.secretsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secrets file: %v", err)
+		}
+		if err := yaml.Unmarshal(b, &stored); err != nil {
+			return nil, fmt.Errorf("unable to decode secrets file %q: %v", cfg.secretsFile, err)
+		}
+	}
+
+	values := map[string]string{}
+	for _, k := range keys {
+		if v, ok := os.LookupEnv(secretEnvVar(k)); ok {
+			values[k] = v
+		} else if v, ok := stored[k]; ok {
+			values[k] = v
+		} else {
+			fmt.Fprintf(cfg.stderr(), "No value for secret %q, the one stored in influxdb will be used\n", k)
+		}
+	}
+	return values, nil
+}
+
+// secretEnvVar returns the environment variable holding the value of a secret.
+func secretEnvVar(key string) string {
+	return secretEnvPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
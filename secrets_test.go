@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const slackTemplate = `apiVersion: influxdata.com/v2alpha1
+kind: NotificationEndpointSlack
+metadata:
+  name: stoic-noether-2a1001
+spec:
+  name: Ops Slack
+  token: %s
+  url: https://hooks.slack.com/services/T000/B000/XXXX
+---
+apiVersion: influxdata.com/v2alpha1
+kind: NotificationEndpointHTTP
+metadata:
+  name: tender-carson-9d8001
+spec:
+  method: POST
+  name: Alert Webhook
+  password: %s
+  type: basic
+  url: https://alerts.example.com/influxdb
+  username: admin
+`
+
+func TestSecrets(t *testing.T) {
+	f, srv := newFakeInflux(t, "stack-id", "")
+
+	src := filepath.Join(t.TempDir(), "template.yml")
+	template := strings.Replace(slackTemplate, "%s", "xoxb-123", 1)
+	template = strings.Replace(template, "%s", "hunter2", 1)
+	if err := os.WriteFile(src, []byte(template), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+	dir := t.TempDir()
+	if err := split([]string{src, dir}); err != nil {
+		t.Fatalf("Unexpected error splitting template: %v", err)
+	}
+	replaceInFile(t, filepath.Join(dir, "NotificationEndpointSlack/Ops Slack/template.yml"),
+		"{secretRef: {key: stoic-noether-2a1001-token}}", `{{ secret "slack-token" }}`)
+	replaceInFile(t, filepath.Join(dir, "NotificationEndpointHTTP/Alert Webhook/template.yml"),
+		"{secretRef: {key: tender-carson-9d8001-password}}", `{{ secret "webhook-password" }}`)
+
+	secretsFile := filepath.Join(t.TempDir(), "secrets.yml")
+	if err := os.WriteFile(secretsFile, []byte("slack-token: from-file\nwebhook-password: hunter2\n"), 0644); err != nil {
+		t.Fatalf("Unable to write secrets: %v", err)
+	}
+	os.Setenv("INFLUX_SECRET_SLACK_TOKEN", "xoxb-456")
+	defer os.Unsetenv("INFLUX_SECRET_SLACK_TOKEN")
+
+	err := push([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token",
+		"--org", "my-org", "--force", "true", "-d", dir, "--secrets-file", secretsFile})
+	if err != nil {
+		t.Fatalf("Unexpected error pushing template: %v", err)
+	}
+
+	// The environment takes precedence over the secrets file.
+	// The username was redacted by split, and has no value, so is left out.
+	exp := map[string]string{"slack-token": "xoxb-456", "webhook-password": "hunter2"}
+	if diff := cmp.Diff(exp, f.applied[0].Secrets); diff != "" {
+		t.Errorf("Unexpected secrets applied:\n%s", diff)
+	}
+
+	// Only references to the secrets are in the template.
+	for _, obj := range f.applied[0].Template.Contents {
+		spec := obj.(map[string]interface{})["spec"].(map[string]interface{})
+		for _, field := range []string{"token", "password"} {
+			if v, ok := spec[field]; ok {
+				if _, ok := v.(map[string]interface{})["secretRef"]; !ok {
+					t.Errorf("Expected %s to be a secret reference, got %v", field, v)
+				}
+			}
+		}
+	}
+}
+
+func TestSplitRedactsSecrets(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "template.yml")
+	template := strings.Replace(slackTemplate, "%s", "xoxb-123", 1)
+	template = strings.Replace(template, "%s", "hunter2", 1)
+	if err := os.WriteFile(src, []byte(template), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := split([]string{src, dir}); err != nil {
+		t.Fatalf("Unexpected error splitting template: %v", err)
+	}
+
+	for filename, exp := range map[string][]string{
+		"NotificationEndpointSlack/Ops Slack/template.yml": {
+			"token: {secretRef: {key: stoic-noether-2a1001-token}}",
+		},
+		"NotificationEndpointHTTP/Alert Webhook/template.yml": {
+			"password: {secretRef: {key: tender-carson-9d8001-password}}",
+			"username: {secretRef: {key: tender-carson-9d8001-username}}",
+		},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, filename))
+		if err != nil {
+			t.Fatalf("Unable to read template: %v", err)
+		}
+		for _, s := range exp {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("Expected %q to contain %q, got:\n%s", filename, s, b)
+			}
+		}
+		for _, s := range []string{"xoxb-123", "hunter2"} {
+			if strings.Contains(string(b), s) {
+				t.Errorf("Expected %q to not contain the secret %q", filename, s)
+			}
+		}
+	}
+}
+
+func TestCLIDryRunRedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	b := cliBackend{cfg: config{influxCmd: "influx", dryRun: true, out: &buf}}
+	if err := b.apply("stack-id", "template.yml", "true", map[string]string{"slack-token": "xoxb-123"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "--secret slack-token="+redacted) || strings.Contains(buf.String(), "xoxb-123") {
+		t.Errorf("Expected the secret to be redacted, got:\n%s", buf.String())
+	}
+}
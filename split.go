@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,9 @@ import (
 	"strings"
 	"unicode"
 
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
+	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,18 +21,39 @@ const splitUsage = `
 Split a template file into separate templates and flux queries.
 
 Usage:
-  influxdb-stack-manager split <src> <dest>
+  influxdb-stack-manager split <src> <dest> [flags]
 
-Where src is a yaml template file, and dest is a directory.
+Where src is a template file, and dest is a directory. The template can either
+be yaml documents, or a json array of objects, as exported by influx.
 Warning: This is a destructive operation, the destination directory will be
 cleared if it already exists.
+
+Flags:
 `
 
 // split a file into separate templates and extract any flux code into its own file.
 func split(args []string) error {
+	var extractorsFile string
+	var help bool
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	fs.StringVar(&extractorsFile, "extractors", "", "File declaring extra nodes to extract from templates")
+	fs.BoolVarP(&help, "help", "h", false, "Display help for this command.")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager split -h' for help", err)
+	}
+
+	args = fs.Args()
+	if help {
+		log.Println(splitUsage + fs.FlagUsages())
+		return nil
+	}
 	if len(args) != 2 {
-		log.Println(splitUsage)
-		return errors.New("expected exactly two args")
+		return errors.New("Error: expected exactly two args\nSee 'influxdb-stack-manager split -h' for help")
+	}
+
+	ex, err := loadExtractors(extractorsFile)
+	if err != nil {
+		return err
 	}
 
 	f, err := os.Open(args[0])
@@ -37,7 +62,16 @@ func split(args []string) error {
 	}
 	defer f.Close()
 
-	if err := splitTemplate(args[1], f); err != nil {
+	var r io.Reader = f
+	if filepath.Ext(args[0]) == ".json" {
+		var buf bytes.Buffer
+		if err := jsonToYAML(f, &buf); err != nil {
+			return fmt.Errorf("couldn't convert json template %q: %v", args[0], err)
+		}
+		r = &buf
+	}
+
+	if err := splitTemplate(args[1], r, ex); err != nil {
 		return fmt.Errorf("couldn't split template: %v", err)
 	}
 
@@ -46,25 +80,22 @@ func split(args []string) error {
 
 // split the contents of the reader into separate templates and extract any flux code
 // into their own files, organised under the supplied directory.
-func splitTemplate(dir string, r io.Reader) error {
+func splitTemplate(dir string, r io.Reader, ex extract.Set) error {
 	// Clear the template directory, so we aren't left with any orphans.
-	if err := os.RemoveAll(dir); err != nil {
+	// Our own state is kept, as it isn't part of the template.
+	if err := clearDir(dir); err != nil {
 		return fmt.Errorf("unable to clear template directory: %w", err)
 	}
 
+	objs, err := decodeObjects(r)
+	if err != nil {
+		return err
+	}
+
 	// Set of names that we've already seen, used to check for name collisions.
 	seenNames := map[string]struct{}{}
 
-	decoder := yaml.NewDecoder(r)
-	for {
-		var obj object
-		if err := decoder.Decode(&obj); err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			return fmt.Errorf("unable to decode template: %v", err)
-		}
-
+	for _, obj := range objs {
 		dir := filepath.Join(dir, obj.Kind, escapeName(walkNode(&obj.Spec, "name").Value))
 		if _, ok := seenNames[dir]; ok {
 			// If we have a name collision, just error, we don't know how to organise two
@@ -73,35 +104,19 @@ func splitTemplate(dir string, r io.Reader) error {
 		}
 		seenNames[dir] = struct{}{}
 
+		// Never write secrets to disk, reference them instead.
+		for _, key := range redactSecrets(&obj) {
+			log.Printf("Redacted secret %q in %s, set its value with --secrets-file or $%s when pushing", key, obj.id(), secretEnvVar(key))
+		}
+
 		if err := os.MkdirAll(dir, 0700); err != nil {
 			return fmt.Errorf("unable to make directory %q: %v", dir, err)
 		}
 
 		// Find all of the query nodes present in the template.
-		var queryNodes []queryNode
-		switch obj.Kind {
-		case kindDashboard:
-			queryNodes = walkDashboard(&obj.Spec)
-
-		case kindTask:
-			queryNodes = walkTask(&obj.Spec)
-
-		case kindCheck:
-			queryNodes = walkCheck(&obj.Spec)
-		}
-
-		queryNames := map[string]int{}
-		for _, qn := range queryNodes {
-			// Keep track of used query names and, for any duplicates,
-			// add a numerical suffix to distinguish them.
-			name := qn.Name
-			if n, ok := queryNames[name]; ok {
-				name = fmt.Sprintf("%s_%d.flux", qn.Name, n)
-			} else {
-				name = fmt.Sprintf("%s.flux", qn.Name)
-			}
-			name = escapeName(name)
-			queryNames[qn.Name]++
+		queryNodes := ex.Nodes(obj.Kind, &obj.Spec)
+		for i, name := range queryFilenames(queryNodes) {
+			qn := queryNodes[i]
 
 			// Write out the query to file
 			filename := filepath.Join(dir, name)
@@ -125,6 +140,81 @@ func splitTemplate(dir string, r io.Reader) error {
 			return fmt.Errorf("unable to marshal object: %v", err)
 		}
 	}
+
+	// Scoped data files were kept when clearing the directory, even for
+	// resources which are no longer in the template.
+	kinds, err := listKindDirs(dir)
+	if err != nil {
+		return fmt.Errorf("unable to read dir %q: %v", dir, err)
+	}
+	for _, k := range kinds {
+		items, err := os.ReadDir(filepath.Join(dir, k))
+		if err != nil {
+			return fmt.Errorf("unable to read dir %q: %v", filepath.Join(dir, k), err)
+		}
+		for _, item := range items {
+			if resDir := filepath.Join(dir, k, item.Name()); isDataOnly(resDir) {
+				log.Printf("Kept %q, though its resource is no longer in the template", filepath.Join(resDir, scopedDataFile))
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeObjects decodes all of the objects in a template, which is either
+// yaml documents or a json array of objects.
+func decodeObjects(r io.Reader) ([]object, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read template: %v", err)
+	}
+	if isJSONArray(b) {
+		var buf bytes.Buffer
+		if err := jsonToYAML(bytes.NewReader(b), &buf); err != nil {
+			return nil, fmt.Errorf("unable to convert json template: %v", err)
+		}
+		b = buf.Bytes()
+	}
+
+	var objs []object
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var obj object
+		if err := decoder.Decode(&obj); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objs, nil
+			}
+			return nil, fmt.Errorf("unable to decode template: %v", err)
+		}
+		objs = append(objs, obj)
+	}
+}
+
+// isJSONArray returns whether the template is a json array. Yaml templates
+// are a stream of objects, so never start with one.
+func isJSONArray(b []byte) bool {
+	trimmed := bytes.TrimLeftFunc(b, unicode.IsSpace)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// queryFilenames returns the name of the file to extract each query node to.
+func queryFilenames(queryNodes []extract.Node) []string {
+	var names []string
+	queryNames := map[string]int{}
+	for _, qn := range queryNodes {
+		// Keep track of used query names and, for any duplicates,
+		// add a numerical suffix to distinguish them.
+		name := qn.Name
+		if n, ok := queryNames[name+qn.Ext]; ok {
+			name = fmt.Sprintf("%s_%d%s", qn.Name, n, qn.Ext)
+		} else {
+			name = qn.Name + qn.Ext
+		}
+		names = append(names, escapeName(name))
+		queryNames[qn.Name+qn.Ext]++
+	}
+	return names
 }
 
 // escapeName removes any characters from a name that are not valid in a filename
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -31,6 +32,41 @@ func TestSplit(t *testing.T) {
 	}
 }
 
+func TestSplitJSON(t *testing.T) {
+	testCases, err := os.ReadDir("testdata/united")
+	if err != nil {
+		t.Fatalf("Unable to read testdata/united dir: %v", err)
+	}
+
+	for _, tc := range testCases {
+		contents, err := readTemplateContents(filepath.Join("testdata/united", tc.Name(), "template.yml"))
+		if err != nil {
+			t.Fatalf("Unable to read template: %v", err)
+		}
+		b, err := json.Marshal(contents)
+		if err != nil {
+			t.Fatalf("Unable to encode template: %v", err)
+		}
+
+		// Json is recognised by the file extension, or the contents.
+		for _, name := range []string{"template.json", "template"} {
+			t.Run(filepath.Join(tc.Name(), name), func(t *testing.T) {
+				filename := filepath.Join(t.TempDir(), name)
+				if err := os.WriteFile(filename, b, 0644); err != nil {
+					t.Fatalf("Unable to write template: %v", err)
+				}
+
+				dir := t.TempDir()
+				if err := split([]string{filename, dir}); err != nil {
+					t.Fatalf("Unexpected error splitting template: %v", err)
+				}
+
+				compareDirs(t, dir, filepath.Join("testdata/split", tc.Name()))
+			})
+		}
+	}
+}
+
 // compareDirs compares the contents of two directories and makes sure
 // that they are both the same
 func compareDirs(t *testing.T, dir0, dir1 string) {
@@ -77,7 +113,7 @@ func compareDirs(t *testing.T, dir0, dir1 string) {
 			if diff := cmp.Diff(tmpl0, tmpl1); diff != "" {
 				t.Errorf("File contents different:\n%s", diff)
 			}
-			return
+			continue
 		}
 
 		// Otherwise, compare the strings
@@ -97,6 +133,10 @@ func walkDir(t *testing.T, dir string, ch chan string) {
 			return err
 		}
 		if d.IsDir() {
+			// Our own state isn't part of the split template.
+			if d.Name() == stateDir {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+const stacksUsage = `Manage the stack that a template directory belongs to.
+
+Usage:
+  influxdb-stack-manager stacks <command> [flags]
+
+Available Commands:
+  list			List the stacks in the organization.
+  init			Create a new stack, and save its ID in the template directory.
+  add-resource		Add existing resources, given as <kind>=<id>, to the stack.
+  remove-resource	Remove resources, given as <kind>=<id>, from the template directory.
+			Influxdb can't detach a resource from a stack, so the next push
+			will DELETE it from influxdb.
+  delete		Delete the stack, and all of its resources, from influxdb.
+
+The stack ID saved in the template directory is used by push and pull when
+no stack-id is given, and by these commands unless --stack-id is set.
+
+Flags:
+`
+
+func stacks(args []string) error {
+	var cfg config
+	var stackID, name, description string
+	var force bool
+
+	fs := cfg.flagSet()
+	fs.StringVar(&stackID, "stack-id", "", "ID of the stack, if not the one saved in the template directory.")
+	fs.StringVarP(&name, "name", "n", "", "Name of the stack to create.")
+	fs.StringVar(&description, "description", "", "Description of the stack to create.")
+	fs.BoolVar(&force, "force", false, "Delete the stack, or remove resources, without asking for confirmation.")
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager stacks -h' for help", err)
+	}
+
+	if cfg.help || fs.NArg() == 0 {
+		log.Println(stacksUsage + fs.FlagUsages())
+		return nil
+	}
+
+	b, err := cfg.newBackend()
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	// Only the list and init commands don't act on an existing stack.
+	var ids []string
+	if stackID != "" {
+		ids = []string{stackID}
+	}
+
+	switch cmd, args := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "list":
+		return stacksList(b)
+
+	case "init":
+		return stacksInit(b, cfg, name, description)
+
+	case "add-resource", "remove-resource", "delete":
+		id, err := cfg.stackID(ids)
+		if err != nil {
+			return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager stacks -h' for help", err)
+		}
+
+		switch cmd {
+		case "add-resource":
+			return stacksAddResource(b, id, args)
+
+		case "remove-resource":
+			return stacksRemoveResource(b, cfg, id, args, force)
+
+		default:
+			return stacksDelete(b, cfg, id, force)
+		}
+
+	default:
+		return fmt.Errorf("Error: unknown command %q\nSee 'influxdb-stack-manager stacks -h' for help", cmd)
+	}
+}
+
+func stacksList(b backend) error {
+	stacks, err := b.listStacks()
+	if err != nil {
+		return fmt.Errorf("Error: unable to list stacks: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tRESOURCES")
+	for _, s := range stacks {
+		ev := s.latest()
+		fmt.Fprintf(w, "%s\t%s\t%d\n", s.ID, ev.Name, len(ev.Resources))
+	}
+	return w.Flush()
+}
+
+func stacksInit(b backend, cfg config, name, description string) error {
+	if name == "" {
+		return errors.New("Error: required flag missing: --name\nSee 'influxdb-stack-manager stacks -h' for help")
+	}
+
+	// Don't lose track of an existing stack by overwriting its ID.
+	existing, err := readStackID(cfg.directory)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if existing != "" {
+		return fmt.Errorf("Error: %q already belongs to stack %s", cfg.directory, existing)
+	}
+
+	s, err := b.initStack(name, description)
+	if err != nil {
+		return fmt.Errorf("Error: unable to create stack: %v", err)
+	}
+	if cfg.dryRun {
+		return nil
+	}
+
+	if err := writeStackID(cfg.directory, s.ID); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	log.Printf("Created stack %s, and saved its ID in %q", s.ID, cfg.directory)
+	return nil
+}
+
+func stacksAddResource(b backend, stackID string, args []string) error {
+	resources, err := parseResources(args)
+	if err != nil {
+		return err
+	}
+
+	if err := b.addResources(stackID, resources); err != nil {
+		return fmt.Errorf("Error: unable to update stack: %v", err)
+	}
+	return nil
+}
+
+// stacksRemoveResource removes resources from the template directory. Influxdb
+// has no way to detach a resource from a stack, so it will be deleted when the
+// directory is next pushed, and the user must confirm that first.
+func stacksRemoveResource(b backend, cfg config, stackID string, args []string, force bool) error {
+	resources, err := parseResources(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := b.getStack(stackID)
+	if err != nil {
+		return fmt.Errorf("Error: unable to get stack: %v", err)
+	}
+
+	// Find the template name of each resource, so we can find its directory.
+	var dirs []string
+	for _, r := range resources {
+		var metaName string
+		for _, sr := range s.latest().Resources {
+			if sr.Kind == r.Kind && sr.ResourceID == r.ResourceID {
+				metaName = sr.MetaName
+			}
+		}
+		if metaName == "" {
+			return fmt.Errorf("Error: %s=%s is not in stack %s", r.Kind, r.ResourceID, stackID)
+		}
+
+		dir, err := findResourceDir(cfg.directory, r.Kind, metaName)
+		if err != nil {
+			return fmt.Errorf("Error: %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	if cfg.dryRun {
+		for _, dir := range dirs {
+			log.Printf("Dry run - would remove %q", dir)
+		}
+		return nil
+	}
+
+	if !force {
+		prompt := fmt.Sprintf("Influxdb can't detach resources from a stack, so removing them from the template directory\n"+
+			"means the next push will DELETE them from influxdb:\n  %s\nRemove them? (y/n): ", strings.Join(dirs, "\n  "))
+		if !confirm(os.Stdin, os.Stdout, prompt) {
+			return errors.New("Error: aborted removing resources")
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("Error: unable to remove %q: %v", dir, err)
+		}
+		log.Printf("Removed %q, the resource will be deleted from influxdb on the next push", dir)
+	}
+	return nil
+}
+
+func stacksDelete(b backend, cfg config, stackID string, force bool) error {
+	if !force && !cfg.dryRun {
+		prompt := fmt.Sprintf("Delete stack %s and all of its resources from influxdb? (y/n): ", stackID)
+		if !confirm(os.Stdin, os.Stdout, prompt) {
+			return errors.New("Error: aborted deleting stack")
+		}
+	}
+
+	if err := b.deleteStack(stackID); err != nil {
+		return fmt.Errorf("Error: unable to delete stack: %v", err)
+	}
+	if cfg.dryRun {
+		return nil
+	}
+
+	// Forget the stack, if it is the one the directory belonged to.
+	saved, err := readStackID(cfg.directory)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if saved == stackID {
+		if err := removeStackID(cfg.directory); err != nil {
+			return fmt.Errorf("Error: %v", err)
+		}
+	}
+	return nil
+}
+
+func parseResources(args []string) ([]stackResource, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Error: required arg missing: <kind>=<id>\nSee 'influxdb-stack-manager stacks -h' for help")
+	}
+
+	var resources []stackResource
+	for _, arg := range args {
+		r, err := parseResource(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Error: %v", err)
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// findResourceDir finds the directory holding the template for
+// the object with the kind and name.
+func findResourceDir(dir, kind, name string) (string, error) {
+	dir = filepath.Join(dir, kind)
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to read dir %q: %w", dir, err)
+	}
+
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+
+		// Directories without a template, such as those only keeping
+		// scoped data, can't hold the resource.
+		filename := filepath.Join(dir, item.Name(), templateFile)
+		b, err := os.ReadFile(filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to read template %q: %v", filename, err)
+		}
+
+		// The template may not be valid yaml until it is executed, but
+		// the metadata should be left alone, so try our best to read it.
+		var obj object
+		if err := yaml.Unmarshal(b, &obj); err == nil && obj.name() == name {
+			return filepath.Join(dir, item.Name()), nil
+		}
+	}
+
+	return "", fmt.Errorf("no template found for %s/%s in %q", kind, name, dir)
+}
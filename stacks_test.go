@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStacksInit(t *testing.T) {
+	f, srv := newFakeInflux(t, "new-stack-id", "testdata/united/multiple-template/template.yml")
+	dir := t.TempDir()
+	flags := []string{"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org", "my-org", "-d", dir}
+
+	if err := stacks(append([]string{"init", "-n", "My Stack"}, flags...)); err != nil {
+		t.Fatalf("Unexpected error creating stack: %v", err)
+	}
+	if id, err := readStackID(dir); err != nil || id != "new-stack-id" {
+		t.Fatalf("Expected stack ID to be saved, got %q, %v", id, err)
+	}
+
+	// A second stack can't be created for the same directory.
+	if err := stacks(append([]string{"init", "-n", "Other Stack"}, flags...)); err == nil {
+		t.Errorf("Expected an error creating a second stack")
+	}
+
+	// Pull and push should both use the saved stack ID, and it should
+	// survive the directory being cleared by the pull.
+	if err := pull(flags); err != nil {
+		t.Fatalf("Unexpected error pulling stack: %v", err)
+	}
+	if id, err := readStackID(dir); err != nil || id != "new-stack-id" {
+		t.Fatalf("Expected stack ID to be kept, got %q, %v", id, err)
+	}
+
+	if err := push(append([]string{"--force", "true", "--allow-external-refs"}, flags...)); err != nil {
+		t.Fatalf("Unexpected error pushing stack: %v", err)
+	}
+	if pushed := f.pushed(); len(pushed) != 1 || pushed[0].StackID != "new-stack-id" {
+		t.Errorf("Expected template to be applied to the saved stack, got: %+v", f.applied)
+	}
+}
+
+func TestStacksMissingID(t *testing.T) {
+	err := push([]string{"-d", t.TempDir()})
+	if err == nil {
+		t.Errorf("Expected an error pushing without a stack ID")
+	}
+}
+
+func TestStacksAddResource(t *testing.T) {
+	f, srv := newFakeInflux(t, "", "")
+	f.stacks["stack-id"] = &stack{ID: "stack-id"}
+
+	err := stacks([]string{"add-resource", "Dashboard=dash-id", "Task=task-id", "--stack-id", "stack-id",
+		"--backend", "http", "--host", srv.URL, "--token", "my-token"})
+	if err != nil {
+		t.Fatalf("Unexpected error adding resources: %v", err)
+	}
+
+	exp := []stackResource{{Kind: "Dashboard", ResourceID: "dash-id"}, {Kind: "Task", ResourceID: "task-id"}}
+	if diff := cmp.Diff(exp, f.patches); diff != "" {
+		t.Errorf("Unexpected resources added:\n%s", diff)
+	}
+
+	err = stacks([]string{"add-resource", "dash-id", "--stack-id", "stack-id",
+		"--backend", "http", "--host", srv.URL, "--token", "my-token"})
+	if err == nil {
+		t.Errorf("Expected an error for a resource without a kind")
+	}
+}
+
+func TestStacksRemoveResource(t *testing.T) {
+	f, srv := newFakeInflux(t, "", "")
+	f.stacks["stack-id"] = &stack{ID: "stack-id", Events: []stackEvent{{
+		Resources: []stackResource{{Kind: "Dashboard", ResourceID: "dash-id", MetaName: "eager-cori-839000"}},
+	}}}
+
+	dir := t.TempDir()
+	copyDir(t, "testdata/split/multiple-template", dir)
+	if err := writeStackID(dir, "stack-id"); err != nil {
+		t.Fatalf("Unable to save stack ID: %v", err)
+	}
+
+	// Data kept for a resource which is no longer in the template doesn't
+	// get in the way of finding the others.
+	if err := os.MkdirAll(filepath.Join(dir, "Dashboard/Removed"), 0755); err != nil {
+		t.Fatalf("Unable to create data dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dashboard/Removed", scopedDataFile), []byte("Every: 1h\n"), 0644); err != nil {
+		t.Fatalf("Unable to write scoped data: %v", err)
+	}
+
+	// Without --force, nothing is removed unless the user confirms.
+	err := stacks([]string{"remove-resource", "Dashboard=dash-id",
+		"--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir})
+	if err == nil {
+		t.Errorf("Expected an error when removing a resource wasn't confirmed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Dashboard/Test Dashboard")); err != nil {
+		t.Errorf("Expected dashboard directory to be kept without confirmation, got: %v", err)
+	}
+
+	err = stacks([]string{"remove-resource", "Dashboard=dash-id", "--force",
+		"--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir})
+	if err != nil {
+		t.Fatalf("Unexpected error removing resource: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "Dashboard/Test Dashboard")); !os.IsNotExist(err) {
+		t.Errorf("Expected dashboard directory to be removed, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Task/CPU Downsample")); err != nil {
+		t.Errorf("Expected task directory to be kept, got: %v", err)
+	}
+}
+
+func TestStacksDelete(t *testing.T) {
+	f, srv := newFakeInflux(t, "", "")
+	f.stacks["stack-id"] = &stack{ID: "stack-id"}
+
+	dir := t.TempDir()
+	if err := writeStackID(dir, "stack-id"); err != nil {
+		t.Fatalf("Unable to save stack ID: %v", err)
+	}
+
+	err := stacks([]string{"delete", "--force",
+		"--backend", "http", "--host", srv.URL, "--token", "my-token", "--org-id", "0123456789abcdef", "-d", dir})
+	if err != nil {
+		t.Fatalf("Unexpected error deleting stack: %v", err)
+	}
+
+	if _, ok := f.stacks["stack-id"]; ok {
+		t.Errorf("Expected stack to be deleted")
+	}
+	if id, err := readStackID(dir); err != nil || id != "" {
+		t.Errorf("Expected saved stack ID to be removed, got %q, %v", id, err)
+	}
+}
+
+// copyDir copies the contents of the src directory into dest.
+func copyDir(t *testing.T, src, dest string) {
+	t.Helper()
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dest, rel), 0700)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dest, rel), b, 0644)
+	})
+	if err != nil {
+		t.Fatalf("unable to copy %q: %v", src, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Directory within the template directory holding the tool's own state.
+	// It is kept when a template is split into the directory, and ignored
+	// when uniting it.
+	stateDir = ".stack-manager"
+
+	// File within the state directory holding the ID of the stack
+	// the templates belong to.
+	stackIDFile = "stack-id"
+
+	// Directory within the state directory holding the template as it was
+	// last pulled, used as the base when merging in a new pull.
+	baseDir = "base"
+
+	// File within the state directory holding a hash of each resource's
+	// directory, as it was last pulled or pushed.
+	snapshotFile = "snapshot.json"
+
+	// Directory within the state directory holding the templates exported
+	// from each stack before it was pushed to, by stack ID.
+	backupsDir = "backups"
+)
+
+// readStackID returns the stack ID saved in the template directory,
+// or an empty string if there isn't one.
+func readStackID(dir string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, stateDir, stackIDFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to read stack ID: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeStackID saves the stack ID in the template directory.
+func writeStackID(dir, stackID string) error {
+	if err := os.MkdirAll(filepath.Join(dir, stateDir), 0700); err != nil {
+		return fmt.Errorf("unable to create state directory: %v", err)
+	}
+
+	filename := filepath.Join(dir, stateDir, stackIDFile)
+	if err := os.WriteFile(filename, []byte(stackID+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write stack ID: %v", err)
+	}
+	return nil
+}
+
+// removeStackID removes the stack ID from the template directory.
+func removeStackID(dir string) error {
+	err := os.Remove(filepath.Join(dir, stateDir, stackIDFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to remove stack ID: %v", err)
+	}
+	return nil
+}
+
+// readSnapshot returns the snapshot saved in the template directory,
+// or nil if there isn't one.
+func readSnapshot(dir string) (map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, stateDir, snapshotFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read snapshot: %v", err)
+	}
+
+	var snapshot map[string]string
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, fmt.Errorf("unable to decode snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// writeSnapshot saves a snapshot of the resources in src in the
+// template directory.
+func writeSnapshot(dir, src string) error {
+	snapshot, err := hashResources(src)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode snapshot: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, stateDir), 0700); err != nil {
+		return fmt.Errorf("unable to create state directory: %v", err)
+	}
+
+	filename := filepath.Join(dir, stateDir, snapshotFile)
+	if err := os.WriteFile(filename, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write snapshot: %v", err)
+	}
+	return nil
+}
+
+// stackID returns the stack ID passed as an argument, falling back to the
+// one from the environment, then the one saved in the template directory.
+func (cfg config) stackID(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	if cfg.envStackID != "" {
+		return cfg.envStackID, nil
+	}
+
+	id, err := readStackID(cfg.directory)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", fmt.Errorf("required arg missing: stack-id, and no stack ID is saved in %q", cfg.directory)
+	}
+	return id, nil
+}
+
+// clearDir removes everything in the directory apart from the state directory,
+// and the scoped data files in it and in the kind and resource directories,
+// which are written by hand rather than pulled.
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Name() == stateDir {
+			continue
+		}
+		if _, err := clearKeepingData(filepath.Join(dir, e.Name()), e, 2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearKeepingData removes the file, or directory, apart from any scoped data
+// files found within depth levels of it. A directory is only removed if
+// nothing in it is kept. It returns whether anything was kept.
+func clearKeepingData(name string, e fs.DirEntry, depth int) (bool, error) {
+	if !e.IsDir() {
+		if e.Name() == scopedDataFile {
+			return true, nil
+		}
+		return false, os.Remove(name)
+	}
+	if depth == 0 {
+		return false, os.RemoveAll(name)
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return false, err
+	}
+	var kept bool
+	for _, e := range entries {
+		k, err := clearKeepingData(filepath.Join(name, e.Name()), e, depth-1)
+		if err != nil {
+			return false, err
+		}
+		kept = kept || k
+	}
+	if kept {
+		return true, nil
+	}
+	return false, os.Remove(name)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+const statusUsage = `Show which resources in the template directory have changed.
+
+Each resource's directory is compared with the snapshot recorded by the last
+pull or push, without calling influxdb. Resources are listed as added,
+modified, removed or unchanged.
+
+Usage:
+  influxdb-stack-manager status [flags]
+
+Flags:
+`
+
+// A resourceStatus is the status of a resource's directory,
+// relative to the template directory.
+type resourceStatus struct {
+	Dir    string
+	Status string
+}
+
+func status(args []string) error {
+	var cfg config
+	fs := cfg.flagSet()
+	if err := cfg.parse(fs, args); err != nil {
+		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager status -h' for help", err)
+	}
+
+	if cfg.help {
+		log.Println(statusUsage + fs.FlagUsages())
+		return nil
+	}
+
+	statuses, err := resourceStatuses(cfg.directory)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s:\t%s\n", s.Status, s.Dir)
+	}
+	return w.Flush()
+}
+
+// resourceStatuses compares each resource in the directory with the last
+// snapshot, returning their statuses ordered by directory.
+func resourceStatuses(dir string) ([]resourceStatus, error) {
+	snapshot, err := readSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("no snapshot found in %q, pull or push the directory first", dir)
+	}
+
+	current, err := hashResources(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []resourceStatus
+	for d, hash := range current {
+		s := resourceStatus{Dir: d, Status: statusUnchanged}
+		if old, ok := snapshot[d]; !ok {
+			s.Status = statusAdded
+		} else if old != hash {
+			s.Status = statusModified
+		}
+		statuses = append(statuses, s)
+	}
+	for d := range snapshot {
+		if _, ok := current[d]; !ok {
+			statuses = append(statuses, resourceStatus{Dir: d, Status: statusRemoved})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Dir < statuses[j].Dir
+	})
+	return statuses, nil
+}
+
+// hashResources returns a hash of the contents of each resource's directory,
+// keyed by its path, Kind/name, relative to the template directory.
+func hashResources(dir string) (map[string]string, error) {
+	kinds, err := listKindDirs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dir %q: %w", dir, err)
+	}
+
+	hashes := map[string]string{}
+	for _, k := range kinds {
+		items, err := os.ReadDir(filepath.Join(dir, k))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read dir %q: %w", filepath.Join(dir, k), err)
+		}
+
+		for _, item := range items {
+			if !item.IsDir() || isDataOnly(filepath.Join(dir, k, item.Name())) {
+				continue
+			}
+
+			hash, err := hashDir(filepath.Join(dir, k, item.Name()))
+			if err != nil {
+				return nil, err
+			}
+			hashes[path.Join(k, item.Name())] = hash
+		}
+	}
+	return hashes, nil
+}
+
+// hashDir returns a hash of the names and contents of all the files in a
+// directory. Its scoped data file is left out, as it is data rather than part
+// of the resource, and is never pulled.
+func hashDir(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == scopedDataFile {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		// Write the lengths too, so that moving bytes between the name
+		// and contents of files changes the hash.
+		fmt.Fprintf(h, "%d:%s:%d:", len(rel), filepath.ToSlash(rel), len(b))
+		h.Write(b)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to hash %q: %v", dir, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStatus(t *testing.T) {
+	_, srv := newFakeInflux(t, "stack-id", "testdata/united/multiple-template/template.yml")
+	dir := t.TempDir()
+
+	if _, err := resourceStatuses(dir); err == nil {
+		t.Errorf("Expected an error without a snapshot")
+	}
+
+	err := pull([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token", "-d", dir})
+	if err != nil {
+		t.Fatalf("Unexpected error pulling template: %v", err)
+	}
+
+	replaceInFile(t, filepath.Join(dir, "CheckThreshold/CPU Usage/query.flux"), `"usage_user"`, `"usage_system"`)
+	if err := os.RemoveAll(filepath.Join(dir, "Task")); err != nil {
+		t.Fatalf("Unable to remove task: %v", err)
+	}
+	copyDir(t, "testdata/split/single-variable", dir)
+
+	statuses, err := resourceStatuses(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error getting status: %v", err)
+	}
+	exp := []resourceStatus{
+		{Dir: "CheckThreshold/CPU Usage", Status: statusModified},
+		{Dir: "Dashboard/Test Dashboard", Status: statusUnchanged},
+		{Dir: "Label/Version Controlled", Status: statusUnchanged},
+		{Dir: "Task/CPU Downsample", Status: statusRemoved},
+		{Dir: "Variable/host", Status: statusAdded},
+	}
+	if diff := cmp.Diff(exp, statuses); diff != "" {
+		t.Errorf("Unexpected statuses:\n%s", diff)
+	}
+
+	// Pushing makes the directory the new snapshot.
+	err = push([]string{"stack-id", "--backend", "http", "--host", srv.URL, "--token", "my-token",
+		"--org", "my-org", "--force", "true", "-d", dir})
+	if err != nil {
+		t.Fatalf("Unexpected error pushing template: %v", err)
+	}
+
+	statuses, err = resourceStatuses(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error getting status: %v", err)
+	}
+	for _, s := range statuses {
+		if s.Status != statusUnchanged {
+			t.Errorf("Expected %q to be unchanged after a push, got %s", s.Dir, s.Status)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"path"
 
 	"gopkg.in/yaml.v3"
 )
@@ -10,9 +10,17 @@ const (
 	// Filename for the template file in any directory.
 	templateFile = "template.yml"
 
+	// Filename for data scoped to a kind or resource directory, which is
+	// merged over the global data for the templates within it.
+	scopedDataFile = "data.yml"
+
 	// prefix added to the filename to indicate a query has
 	// been moved to it's own file.
 	queryPrefix = "file://"
+
+	// Formats that whole templates can be read and written in.
+	formatYAML = "yaml"
+	formatJSON = "json"
 )
 
 // An object is the basic type for all templates.
@@ -25,69 +33,43 @@ type object struct {
 	Spec       yaml.Node `yaml:"spec"`
 }
 
-// The different kinds of object that we can receive.
-// Only those objects which contain queries are included here.
-const (
-	kindCheck     string = "CheckThreshold"
-	kindDashboard string = "Dashboard"
-	kindLabel     string = "Label"
-	kindTask      string = "Task"
-)
-
-// A queryNode contains the name for the query, generated from the chart/task/check
-// it belongs to, and a pointer to the node so it may be updated.
-type queryNode struct {
-	Name string
-	Node *yaml.Node
+// name returns the object's name from its metadata, which is used to refer
+// to it from other objects in the template.
+func (obj *object) name() string {
+	return walkNode(&obj.Metadata, "name").Value
 }
 
-// walkDashboard walks a dashboard spec, and finds all of the query nodes.
-// We name each query node after the chart it is in, using the chart name
-// and type. If a chart has multiple queries, or two charts have the same
-// name and type, the names will not be unique.
-func walkDashboard(spec *yaml.Node) []queryNode {
-	var queryNodes []queryNode
-
-	// The query nodes can be found at spec.charts[].queries[].query
-	// where a [] indicates there is an array of charts/queries.
-	charts := walkNode(spec, "charts").Content
-	for _, c := range charts {
-		queries := walkNode(c, "queries").Content
-		var nodes []*yaml.Node
-		for _, q := range queries {
-			nodes = append(nodes, walkNode(q, "query"))
-		}
-
-		chartName := walkNode(c, "name").Value
-		chartKind := walkNode(c, "kind").Value
-		name := fmt.Sprintf("%s_%s", chartName, chartKind)
-		for _, node := range nodes {
-			queryNodes = append(queryNodes, queryNode{Name: name, Node: node})
-		}
-	}
-
-	return queryNodes
+// id returns the kind and name of the object, to identify it in messages.
+func (obj *object) id() string {
+	return obj.Kind + "/" + obj.name()
 }
 
-// walkTask walks a task spec, and finds the query node.
-// This returns a list to match the other walk function, but will only
-// ever contain one member.
-func walkTask(spec *yaml.Node) []queryNode {
-	return []queryNode{{
-		Name: "query",
-		Node: walkNode(spec, "query"),
-	}}
+// dir returns the directory, relative to the template directory, that the
+// object is split into, named by the name in its spec.
+func (obj *object) dir() string {
+	name := walkNode(&obj.Spec, "name").Value
+	if name == "" {
+		name = obj.name()
+	}
+	return path.Join(obj.Kind, escapeName(name))
 }
 
-// walkCheck walks a check spec and finds the query node.
-// This returns a list to match the other walk function, but will only
-// ever contain one member.
-func walkCheck(spec *yaml.Node) []queryNode {
-	return []queryNode{{
-		Name: "query",
-		Node: walkNode(spec, "query"),
-	}}
-}
+// The different kinds of object that we can receive.
+// Only those objects which contain queries are included here.
+const (
+	kindBucket            string = "Bucket"
+	kindCheck             string = "CheckThreshold"
+	kindDashboard         string = "Dashboard"
+	kindDeadman           string = "CheckDeadman"
+	kindEndpointHTTP      string = "NotificationEndpointHTTP"
+	kindEndpointPagerDuty string = "NotificationEndpointPagerDuty"
+	kindEndpointSlack     string = "NotificationEndpointSlack"
+	kindLabel             string = "Label"
+	kindRule              string = "NotificationRule"
+	kindTask              string = "Task"
+	kindTelegraf          string = "Telegraf"
+	kindVariable          string = "Variable"
+)
 
 // walkNode will walk a node's children, looking for the value
 // node that matches the key.
@@ -9,10 +9,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"text/template"
 
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 )
@@ -23,17 +24,23 @@ Unite a set of templates/flux queries back into a single template.
 Usage:
   influxdb-stack-manager unite <src> <dest> [flags]
 
-Where src is a directory, and dest is a template file.
+Where src is a directory, and dest is a template file. The template is
+written as yaml documents, or with --format json as a json array of objects.
 
 Flags:
 `
 
 // unite separated template files and flux queries into a single template.
 func unite(args []string) error {
-	var dataFile string
-	var help bool
+	var data dataOptions
+	var extractorsFile string
+	var format string
+	var help, external bool
 	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
-	fs.StringVar(&dataFile, "data-file", "", "Data file to use for injected data in templates")
+	data.flags(fs)
+	fs.StringVar(&format, "format", formatYAML, "Format of the template to write, 'yaml' or 'json'.")
+	fs.StringVar(&extractorsFile, "extractors", "", "File declaring extra nodes to extract from templates")
+	fs.BoolVar(&external, "allow-external-refs", false, "Allow associations and notification endpoints which are not in the template, as they already exist in influxdb.")
 	fs.BoolVarP(&help, "help", "h", false, "Display help for this command.")
 	if err := fs.Parse(args); err != nil {
 		return fmt.Errorf("Error: %v\nSee 'influxdb-stack-manager push -h' for help", err)
@@ -48,107 +55,187 @@ func unite(args []string) error {
 		return errors.New("Error: wrong number of args\nSee 'influxdb-stack-manager unite -h' for help")
 	}
 
+	if format != formatYAML && format != formatJSON {
+		return fmt.Errorf("Error: unknown format %q, expected 'yaml' or 'json'\nSee 'influxdb-stack-manager unite -h' for help", format)
+	}
+
+	ex, err := loadExtractors(extractorsFile)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Create(args[1])
 	if err != nil {
 		return fmt.Errorf("couldn't create template file %q: %v", args[1], err)
 	}
 	defer f.Close()
 
-	if err := uniteTemplate(args[0], f, dataFile); err != nil {
-		return fmt.Errorf("couldn't split template: %v", err)
+	if err := uniteTemplate(args[0], f, data, format, ex, external); err != nil {
+		return fmt.Errorf("couldn't unite template: %v", err)
 	}
 
 	return nil
 }
 
 // uniteTemplate walks a directory, finding all templates, reintegrating any flux queries that have been
-// separated into their own files, and then writing them back to the writer.
-func uniteTemplate(dir string, w io.Writer, dataFile string) error {
-	data, err := loadDataFile(dataFile)
+// separated into their own files, and then writing them back to the writer in the format.
+func uniteTemplate(dir string, w io.Writer, opts dataOptions, format string, ex extract.Set, external bool) error {
+	data, overrides, err := opts.load()
 	if err != nil {
-		return fmt.Errorf("unable to load data file: %v", err)
+		return fmt.Errorf("unable to load data: %v", err)
+	}
+
+	objs, err := loadObjects(dir, data, overrides, ex, external)
+	if err != nil {
+		return err
+	}
+
+	if format == formatJSON {
+		return encodeJSON(w, objs)
 	}
 
 	enc := yaml.NewEncoder(w)
 	enc.SetIndent(2)
 	defer enc.Close()
 
+	for _, obj := range objs {
+		if err := enc.Encode(obj); err != nil {
+			return fmt.Errorf("unable to encode object: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// encodeJSON writes the objects as a json array, as accepted by influx apply.
+func encodeJSON(w io.Writer, objs []object) error {
+	contents := []interface{}{}
+	for _, obj := range objs {
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("unable to encode object: %v", err)
+		}
+
+		var v interface{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("unable to encode object: %v", err)
+		}
+		contents = append(contents, v)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(contents); err != nil {
+		return fmt.Errorf("unable to encode template: %v", err)
+	}
+	return nil
+}
+
+// loadObjects reads all of the templates in a directory, injecting the data and
+// reintegrating any flux queries that have been separated into their own files.
+// The overrides are applied last, over any scoped data.
+// The objects are returned in the order they should be applied, and unless
+// external is set, must only refer to each other.
+func loadObjects(dir string, data interface{}, overrides []dataOverride, ex extract.Set, external bool) ([]object, error) {
 	kinds, err := listKindDirs(dir)
 	if err != nil {
-		return fmt.Errorf("unable to read dir %q: %w", dir, err)
+		return nil, fmt.Errorf("unable to read dir %q: %w", dir, err)
 	}
 
+	var objs []object
 	for _, k := range kinds {
 		dir := filepath.Join(dir, k)
 		items, err := os.ReadDir(dir)
 		if err != nil {
-			return fmt.Errorf("unable to read dir %q: %w", dir, err)
+			return nil, fmt.Errorf("unable to read dir %q: %w", dir, err)
+		}
+
+		kindData, err := scopeData(data, dir)
+		if err != nil {
+			return nil, err
 		}
 
 		for _, item := range items {
-			if !item.IsDir() {
+			dir := filepath.Join(dir, item.Name())
+			if !item.IsDir() || isDataOnly(dir) {
 				continue
 			}
-			dir := filepath.Join(dir, item.Name())
 
-			tmpl, err := template.ParseGlob(filepath.Join(dir, "*"))
+			data, err := scopeData(kindData, dir)
+			if err != nil {
+				return nil, err
+			}
+			if len(overrides) > 0 {
+				if data, err = applyOverrides(copyData(data), overrides, nil); err != nil {
+					return nil, err
+				}
+			}
+
+			tmpl, err := parseTemplateDir(dir)
 			if err != nil {
-				return fmt.Errorf("unable to parse files in %q: %v", dir, err)
+				return nil, fmt.Errorf("unable to parse files in %q: %v", dir, err)
 			}
 			tmpl = tmpl.Option("missingkey=error")
 
 			var buf bytes.Buffer
 			if err := tmpl.ExecuteTemplate(&buf, templateFile, data); err != nil {
-				return fmt.Errorf("unable to execute template file %q: %v", filepath.Join(dir, templateFile), err)
+				return nil, fmt.Errorf("unable to execute template file %q: %v", filepath.Join(dir, templateFile), err)
 			}
 
 			var obj object
 			if err := yaml.Unmarshal(buf.Bytes(), &obj); err != nil {
-				return fmt.Errorf("unable to decode template %q: %v", filepath.Join(dir, templateFile), err)
+				return nil, fmt.Errorf("unable to decode template %q: %v", filepath.Join(dir, templateFile), err)
 			}
 
 			// Find all query strings that need to be reunited.
-			var queryNodes []queryNode
-			switch obj.Kind {
-			case kindCheck:
-				queryNodes = walkCheck(&obj.Spec)
-
-			case kindDashboard:
-				queryNodes = walkDashboard(&obj.Spec)
+			queryNodes := ex.Nodes(obj.Kind, &obj.Spec)
 
-			case kindTask:
-				queryNodes = walkTask(&obj.Spec)
-			}
+			// Every file in the directory has already been parsed
+			// as a template, so we can execute the extracted ones.
+			for _, qn := range queryNodes {
+				if !strings.HasPrefix(qn.Node.Value, queryPrefix) {
+					continue
+				}
 
-			if len(queryNodes) > 0 {
-				tmpl, err := template.ParseGlob(filepath.Join(dir, "*.flux"))
+				filename := strings.TrimPrefix(qn.Node.Value, queryPrefix)
+				var buf bytes.Buffer
+				err := tmpl.ExecuteTemplate(&buf, filename, data)
 				if err != nil {
-					return fmt.Errorf("unable to parse query files in %q: %s", dir, err)
+					return nil, fmt.Errorf("unable to execute query template %q: %v", filename, err)
 				}
 
-				for _, qn := range queryNodes {
-					if !strings.HasPrefix(qn.Node.Value, queryPrefix) {
-						continue
-					}
-
-					filename := strings.TrimPrefix(qn.Node.Value, queryPrefix)
-					var buf bytes.Buffer
-					err := tmpl.ExecuteTemplate(&buf, filename, data)
-					if err != nil {
-						return fmt.Errorf("unable to execute query template %q: %v", filename, err)
-					}
-
-					qn.Node.SetString(buf.String())
-				}
+				qn.Node.SetString(buf.String())
 			}
 
-			if err := enc.Encode(obj); err != nil {
-				return fmt.Errorf("unable to encode object: %v", err)
-			}
+			objs = append(objs, obj)
 		}
 	}
 
-	return nil
+	objs, err = orderObjects(objs, external)
+	if err != nil {
+		return nil, fmt.Errorf("unable to order templates: %v", err)
+	}
+	return objs, nil
+}
+
+// parseTemplateDir parses every file in a resource directory as a template,
+// apart from its scoped data.
+func parseTemplateDir(dir string) (*template.Template, error) {
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, item := range items {
+		if !item.IsDir() && item.Name() != scopedDataFile {
+			files = append(files, filepath.Join(dir, item.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no template files found")
+	}
+	return template.New("").Funcs(templateFuncs).ParseFiles(files...)
 }
 
 func loadDataFile(filename string) (interface{}, error) {
@@ -175,7 +262,9 @@ func loadDataFile(filename string) (interface{}, error) {
 	return data, err
 }
 
-// listKindDirs returns a sorted list of directories
+// listKindDirs returns the list of kind directories, in alphabetical order.
+// The objects within them are ordered once they have all been loaded.
+// Hidden directories, such as our own state, are skipped.
 func listKindDirs(dir string) ([]string, error) {
 	dirs, err := os.ReadDir(dir)
 	if err != nil {
@@ -184,22 +273,17 @@ func listKindDirs(dir string) ([]string, error) {
 
 	var kinds []string
 	for _, d := range dirs {
-		if d.IsDir() {
+		if d.IsDir() && !strings.HasPrefix(d.Name(), ".") {
 			kinds = append(kinds, d.Name())
 		}
 	}
 
-	// order which kinds should be added to the combined template.
-	// higher numbers are added first.
-	priority := map[string]int{
-		kindLabel:     4,
-		kindCheck:     3,
-		kindTask:      2,
-		kindDashboard: 1,
-	}
-	sort.Slice(kinds, func(i, j int) bool {
-		return priority[kinds[i]] > priority[kinds[j]]
-	})
-
 	return kinds, nil
 }
+
+// isDataOnly returns whether a resource directory holds nothing but a scoped
+// data file, as a pull leaves once the resource is no longer in the stack.
+func isDataOnly(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 1 && entries[0].Name() == scopedDataFile
+}
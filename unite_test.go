@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/influxdata/influxdb-stack-manager/extract"
+
 	"github.com/google/go-cmp/cmp"
 	"gopkg.in/yaml.v3"
 )
@@ -23,7 +25,7 @@ func TestUnite(t *testing.T) {
 		t.Run(tc.Name(), func(t *testing.T) {
 			src := filepath.Join("testdata/split", tc.Name())
 			dest := filepath.Join(t.TempDir(), "template.yml")
-			err := unite([]string{src, dest})
+			err := unite([]string{src, dest, "--allow-external-refs"})
 			if err != nil {
 				t.Fatalf("Unexpected error uniting template: %v", err)
 			}
@@ -56,7 +58,7 @@ func TestUniteTemplate(t *testing.T) {
 			t.Run(filepath.Join(tc.Name(), f.Name()), func(t *testing.T) {
 				src := filepath.Join("testdata/templated", tc.Name())
 				dest := filepath.Join(t.TempDir(), "template.yml")
-				err := unite([]string{src, dest, "--data-file", dataFile})
+				err := unite([]string{src, dest, "--data-file", dataFile, "--allow-external-refs"})
 				if err != nil {
 					t.Fatalf("Unexpected error uniting template: %v", err)
 				}
@@ -67,6 +69,34 @@ func TestUniteTemplate(t *testing.T) {
 	}
 }
 
+func TestUniteJSON(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "template.json")
+	if err := unite([]string{"testdata/split/multiple-template", dest, "--format", "json", "--allow-external-refs"}); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Unable to read template: %v", err)
+	}
+	var act []interface{}
+	if err := yaml.Unmarshal(b, &act); err != nil {
+		t.Fatalf("Expected a json array, got: %v\n%s", err, b)
+	}
+	sort.Slice(act, func(i, j int) bool {
+		return getItemName(act[i]) < getItemName(act[j])
+	})
+
+	exp := loadOutput(t, "testdata/united/multiple-template/template.yml")
+	if diff := cmp.Diff(exp, act, cmp.Comparer(cmpStrings)); diff != "" {
+		t.Errorf("File contents different:\n%s", diff)
+	}
+
+	if err := unite([]string{"testdata/split/multiple-template", dest, "--format", "toml"}); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
 func testUniteOutput(t *testing.T, dir, dest string) {
 	exp := loadOutput(t, filepath.Join("testdata/united", dir, "template.yml"))
 	act := loadOutput(t, dest)
@@ -109,3 +139,219 @@ func getItemName(item interface{}) string {
 func cmpStrings(a, b string) bool {
 	return strings.TrimSpace(a) == strings.TrimSpace(b)
 }
+
+func TestOrderObjects(t *testing.T) {
+	for name, tc := range map[string]struct {
+		template string
+		external bool
+		exp      []string
+		err      string
+	}{
+		"kind relationships": {
+			template: `
+kind: Dashboard
+metadata: {name: dash}
+---
+kind: NotificationRule
+metadata: {name: rule}
+spec: {endpointName: slack}
+---
+kind: Task
+metadata: {name: task}
+---
+kind: Bucket
+metadata: {name: bucket}
+---
+kind: NotificationEndpointSlack
+metadata: {name: slack}
+---
+kind: Label
+metadata: {name: label}
+`,
+			exp: []string{"Label/label", "Bucket/bucket", "NotificationEndpointSlack/slack", "NotificationRule/rule", "Task/task", "Dashboard/dash"},
+		},
+		"associations": {
+			template: `
+kind: Variable
+metadata: {name: b-var}
+---
+kind: Variable
+metadata: {name: a-var}
+spec:
+  associations:
+    - {kind: Variable, name: b-var}
+`,
+			exp: []string{"Variable/b-var", "Variable/a-var"},
+		},
+		"missing association": {
+			template: `
+kind: Task
+metadata: {name: task}
+spec:
+  associations:
+    - {kind: Label, name: missing}
+`,
+			err: "Task/task is associated with Label/missing, which is not in the template",
+		},
+		"missing endpoint": {
+			template: `
+kind: NotificationRule
+metadata: {name: rule}
+spec: {endpointName: missing}
+`,
+			err: `NotificationRule/rule sends to endpoint "missing", which is not in the template`,
+		},
+		"external references": {
+			template: `
+kind: NotificationRule
+metadata: {name: rule}
+spec: {endpointName: existing-endpoint}
+---
+kind: Task
+metadata: {name: task}
+spec:
+  associations:
+    - {kind: Label, name: existing-label}
+`,
+			external: true,
+			exp:      []string{"NotificationRule/rule", "Task/task"},
+		},
+		"cycle": {
+			template: `
+kind: Label
+metadata: {name: label}
+spec:
+  associations:
+    - {kind: Task, name: task}
+---
+kind: Task
+metadata: {name: task}
+---
+kind: Dashboard
+metadata: {name: dash}
+`,
+			err: "dependency cycle detected between: Label/label, Task/task",
+		},
+		"separate cycles": {
+			template: `
+kind: Variable
+metadata: {name: a}
+spec:
+  associations:
+    - {kind: Variable, name: b}
+---
+kind: Variable
+metadata: {name: b}
+spec:
+  associations:
+    - {kind: Variable, name: a}
+---
+kind: Variable
+metadata: {name: c}
+spec:
+  associations:
+    - {kind: Variable, name: d}
+---
+kind: Variable
+metadata: {name: d}
+spec:
+  associations:
+    - {kind: Variable, name: c}
+    - {kind: Variable, name: a}
+`,
+			err: "dependency cycle detected between: Variable/a, Variable/b; Variable/c, Variable/d",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var objs []object
+			dec := yaml.NewDecoder(strings.NewReader(tc.template))
+			for {
+				var obj object
+				if err := dec.Decode(&obj); err != nil {
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					t.Fatalf("unable to decode template: %v", err)
+				}
+				objs = append(objs, obj)
+			}
+
+			ordered, err := orderObjects(objs, tc.external)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("Expected error %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error ordering objects: %v", err)
+			}
+
+			var ids []string
+			for _, obj := range ordered {
+				ids = append(ids, obj.id())
+			}
+			if diff := cmp.Diff(tc.exp, ids); diff != "" {
+				t.Errorf("Unexpected order:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUniteScopedData(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"data.yml":              "Every: 1h\nThresholds:\n  CPU: 75\n  Memory: 60\n",
+		"Task/data.yml":         "Every: 5m\n",
+		"Task/cpu/data.yml":     "Thresholds:\n  CPU: 90\n",
+		"Task/cpu/template.yml": "apiVersion: influxdata.com/v2alpha1\nkind: Task\nmetadata:\n  name: cpu\nspec:\n  every: {{ .Every }}\n  query: file://query.flux\n",
+		"Task/cpu/query.flux":   "cpu > {{ .Thresholds.CPU }} and mem > {{ .Thresholds.Memory }}",
+		"Task/mem/template.yml": "apiVersion: influxdata.com/v2alpha1\nkind: Task\nmetadata:\n  name: mem\nspec:\n  every: {{ .Every }}\n  query: file://query.flux\n",
+		"Task/mem/query.flux":   "cpu > {{ .Thresholds.CPU }} and mem > {{ .Thresholds.Memory }}",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatalf("Unable to create dir: %v", err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+	}
+
+	var buf strings.Builder
+	if err := uniteTemplate(dir, &buf, dataOptions{files: []string{filepath.Join(dir, "data.yml")}}, formatYAML, extract.Builtin(), false); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+
+	var act []interface{}
+	dec := yaml.NewDecoder(strings.NewReader(buf.String()))
+	for {
+		var item map[string]interface{}
+		if err := dec.Decode(&item); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatalf("Unable to decode template: %v", err)
+		}
+		act = append(act, item["spec"])
+	}
+
+	exp := []interface{}{
+		map[string]interface{}{"every": "5m", "query": "cpu > 90 and mem > 60"},
+		map[string]interface{}{"every": "5m", "query": "cpu > 75 and mem > 60"},
+	}
+	if diff := cmp.Diff(exp, act); diff != "" {
+		t.Errorf("Unexpected specs (-want +got):\n%s", diff)
+	}
+
+	// Values set on the command line take precedence over scoped data.
+	buf.Reset()
+	opts := dataOptions{files: []string{filepath.Join(dir, "data.yml")}, sets: []string{"Thresholds.CPU=99"}}
+	if err := uniteTemplate(dir, &buf, opts, formatYAML, extract.Builtin(), false); err != nil {
+		t.Fatalf("Unexpected error uniting template: %v", err)
+	}
+	if n := strings.Count(buf.String(), "cpu > 99 and mem > 60"); n != 2 {
+		t.Errorf("Expected --set to apply to both tasks, got:\n%s", buf.String())
+	}
+}